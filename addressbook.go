@@ -4,42 +4,77 @@ import (
 	"bytes"
 	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 import "os"
 
+// VerificationLevel describes how far the long-term public key of a contact can be trusted
+type VerificationLevel uint8
+
+// VerificationLevel mock enum
+const (
+	UNVERIFIED    VerificationLevel = 0x0 //indicates a key of unknown origin, e.g. imported without trust information
+	SERVERFETCHED VerificationLevel = 0x1 //indicates a key fetched from the directory server and pinned on first use
+	FULLYVERIFIED VerificationLevel = 0x2 //indicates a key verified in person, e.g. by scanning the contact's QR code
+)
+
 // ThreemaContact is the  core contact type, comprising of
 // an ID, a long-term public key, and an optional Name
 type ThreemaContact struct {
-	ID   [8]byte
-	Name string
-	LPK  [32]byte
+	ID          [8]byte
+	Name        string
+	LPK         [32]byte
+	Level       VerificationLevel
+	Nickname    string      // the public nickname the contact last sent
+	FeatureMask FeatureMask // the features supported by the contact's client
+	Blocked     bool        // messages from blocked contacts are dropped
+	FirstSeen   time.Time   // when the contact was added, zero if unknown
+
+	// FeatureMaskFetched is when FeatureMask was last set from the server, zero if never
+	FeatureMaskFetched time.Time
 }
 
 func (tc ThreemaContact) String() string {
 	return string(tc.ID[:])
 }
 
-// AddressBook is the register of ThreemaContacts
+// AddressBook is the register of ThreemaContacts. It is safe for concurrent use and copies share
+// their contacts. Create one with NewAddressBook, a zero value can only be filled by Import,
+// ImportFrom or UnmarshalJSON and other methods panic on it.
 type AddressBook struct {
-	contacts map[string]ThreemaContact
+	mu         *sync.RWMutex
+	contacts   map[string]ThreemaContact
+	keyChanges map[string]KeyChange
+}
+
+// NewAddressBook returns an empty AddressBook
+func NewAddressBook() AddressBook {
+	return AddressBook{
+		mu:         new(sync.RWMutex),
+		contacts:   make(map[string]ThreemaContact),
+		keyChanges: make(map[string]KeyChange)}
 }
 
-func (a AddressBook) slice() [][]string {
-	buf := make([][]string, len(a.contacts))
-	i := 0
-	for _, contact := range a.contacts {
-		buf[i] = make([]string, 3)
-		buf[i][0] = string(contact.ID[:])
-		buf[i][1] = contact.Name
-		buf[i][2] = hex.EncodeToString(contact.LPK[:])
-		i++
+// lock returns the mutex of the AddressBook
+func (a *AddressBook) lock() *sync.RWMutex {
+	if a.mu == nil {
+		panic("o3: AddressBook used without NewAddressBook")
 	}
-	return buf
+	return a.mu
 }
 
-func (a *AddressBook) initializeMap(c int) {
-	a.contacts = make(map[string]ThreemaContact, c)
+// initialize turns a zero value into an empty AddressBook. It is only called by the methods
+// loading a whole AddressBook, which nobody can share before they return.
+func (a *AddressBook) initialize() {
+	if a.mu == nil {
+		*a = NewAddressBook()
+	}
 }
 
 // Import takes a two-dimensional slice of strings and imports it
@@ -47,42 +82,48 @@ func (a *AddressBook) initializeMap(c int) {
 // Fields have to be in the order "ID, Name, LPK" or the function will
 // return an error
 func (a *AddressBook) Import(contacts [][]string) error {
-	a.contacts = make(map[string]ThreemaContact, len(contacts))
-
-	if a.contacts == nil {
-		a.initializeMap(len(contacts))
-	}
+	imported := make(map[string]ThreemaContact, len(contacts))
 
 	for l, c := range contacts {
 		// log.Printf("%#v\n", c)
-		id := c[0]
-		contact := ThreemaContact{Name: c[1]}
-		n := copy(contact.ID[:], id[:])
-		if n != 8 {
-			return fmt.Errorf("line %d: invalid ID length: %d", l, n)
+		id, err := ParseIDString(c[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", l, err)
 		}
+		contact := ThreemaContact{ID: id, Name: c[1]}
 		lpk, err := hex.DecodeString(c[2])
 		if err != nil {
 			return err
 		}
-		n = copy(contact.LPK[0:32], lpk[0:32])
+		n := copy(contact.LPK[0:32], lpk[0:32])
 		if n != 32 {
 			return fmt.Errorf("line %d: invalid pubKey length: %d", l, n)
 		}
-		a.contacts[id] = contact
+		imported[id.String()] = contact
 	}
+
+	a.initialize()
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+	a.replace(imported, nil)
 	return nil
 }
 
-// ImportFrom imports an address book stored in a CSV file
+// ImportFrom imports an address book stored in a file written by SaveTo. Files in the legacy
+// "ID, Name, LPK" CSV format are imported as well, saving the AddressBook afterwards migrates
+// them to the current format.
 func (a *AddressBook) ImportFrom(filename string) error {
-	file, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	rdr := csv.NewReader(file)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return json.Unmarshal(trimmed, a)
+	}
+
+	rdr := csv.NewReader(bytes.NewReader(data))
 	lines, err := rdr.ReadAll()
 	// log.Printf("Read lines: %#v\n", lines)
 	if err != nil {
@@ -91,25 +132,198 @@ func (a *AddressBook) ImportFrom(filename string) error {
 	return a.Import(lines)
 }
 
-// SaveTo stores the AddressBook in the file with the given name
-// in CSV format
-func (a AddressBook) SaveTo(filename string) error {
-	file, err := os.Create(filename)
+// SaveTo stores the AddressBook in the file with the given name in the versioned JSON format.
+// The file is replaced atomically so a crash never leaves a truncated address book behind.
+func (a *AddressBook) SaveTo(filename string) error {
+	data, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+// addressBookVersion is the version of the on-disk format written by SaveTo
+const addressBookVersion = 1
+
+type addressBookFile struct {
+	Version  int             `json:"version"`
+	Contacts []contactRecord `json:"contacts"`
+}
+
+type contactRecord struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	PublicKey   string            `json:"publicKey"`
+	Level       VerificationLevel `json:"verificationLevel"`
+	Nickname    string            `json:"nickname,omitempty"`
+	FeatureMask FeatureMask       `json:"featureMask,omitempty"`
+	Blocked     bool              `json:"blocked,omitempty"`
+	FirstSeen   *time.Time        `json:"firstSeen,omitempty"`
+	// FeatureMaskFetched is only written for masks fetched from the server
+	FeatureMaskFetched *time.Time `json:"featureMaskFetched,omitempty"`
+	// PendingPublicKey is the key of an unresolved KeyChange
+	PendingPublicKey string `json:"pendingPublicKey,omitempty"`
+}
+
+// MarshalJSON encodes the AddressBook in the versioned format written by SaveTo
+func (a *AddressBook) MarshalJSON() ([]byte, error) {
+	mu := a.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	ab := addressBookFile{
+		Version:  addressBookVersion,
+		Contacts: make([]contactRecord, 0, len(a.contacts))}
+	for id, c := range a.contacts {
+		rec := contactRecord{
+			ID:          id,
+			Name:        c.Name,
+			PublicKey:   hex.EncodeToString(c.LPK[:]),
+			Level:       c.Level,
+			Nickname:    c.Nickname,
+			FeatureMask: c.FeatureMask,
+			Blocked:     c.Blocked}
+		if !c.FirstSeen.IsZero() {
+			firstSeen := c.FirstSeen
+			rec.FirstSeen = &firstSeen
+		}
+		if !c.FeatureMaskFetched.IsZero() {
+			fetched := c.FeatureMaskFetched
+			rec.FeatureMaskFetched = &fetched
+		}
+		if kc, ok := a.keyChanges[id]; ok {
+			rec.PendingPublicKey = hex.EncodeToString(kc.New[:])
+		}
+		ab.Contacts = append(ab.Contacts, rec)
+	}
+	sort.Slice(ab.Contacts, func(i, j int) bool { return ab.Contacts[i].ID < ab.Contacts[j].ID })
+
+	return json.Marshal(ab)
+}
+
+// UnmarshalJSON replaces the content of the AddressBook with the encoded contacts
+func (a *AddressBook) UnmarshalJSON(data []byte) error {
+	var ab addressBookFile
+	if err := json.Unmarshal(data, &ab); err != nil {
+		return err
+	}
+	if ab.Version < 1 || ab.Version > addressBookVersion {
+		return fmt.Errorf("unsupported address book version: %d", ab.Version)
+	}
+
+	contacts := make(map[string]ThreemaContact, len(ab.Contacts))
+	keyChanges := make(map[string]KeyChange)
+	for i, rec := range ab.Contacts {
+		id, err := ParseIDString(rec.ID)
+		if err != nil {
+			return fmt.Errorf("contact %d: %s", i, err)
+		}
+		c := ThreemaContact{
+			ID:          id,
+			Name:        rec.Name,
+			Level:       rec.Level,
+			Nickname:    rec.Nickname,
+			FeatureMask: rec.FeatureMask,
+			Blocked:     rec.Blocked}
+		if err := decodeKey(rec.PublicKey, &c.LPK); err != nil {
+			return fmt.Errorf("contact %s: %s", rec.ID, err)
+		}
+		if rec.FirstSeen != nil {
+			c.FirstSeen = *rec.FirstSeen
+		}
+		if rec.FeatureMaskFetched != nil {
+			c.FeatureMaskFetched = *rec.FeatureMaskFetched
+		}
+		if rec.PendingPublicKey != "" {
+			kc := KeyChange{ID: c.ID, Pinned: c.LPK, Level: c.Level}
+			if err := decodeKey(rec.PendingPublicKey, &kc.New); err != nil {
+				return fmt.Errorf("contact %s: %s", rec.ID, err)
+			}
+			keyChanges[rec.ID] = kc
+		}
+		contacts[rec.ID] = c
+	}
+
+	a.initialize()
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+	a.replace(contacts, keyChanges)
+	return nil
+}
+
+// replace refills the maps of the AddressBook in place, so copies sharing them see the new content
+func (a *AddressBook) replace(contacts map[string]ThreemaContact, keyChanges map[string]KeyChange) {
+	for id := range a.contacts {
+		delete(a.contacts, id)
+	}
+	for id, c := range contacts {
+		a.contacts[id] = c
+	}
+	for id := range a.keyChanges {
+		delete(a.keyChanges, id)
+	}
+	for id, kc := range keyChanges {
+		a.keyChanges[id] = kc
+	}
+}
+
+// decodeKey decodes a hex-encoded 32-byte key into key
+func decodeKey(s string, key *[32]byte) error {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(raw) != 32 {
+		return fmt.Errorf("invalid key length: %d", len(raw))
+	}
+	copy(key[:], raw)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filename and renames it to filename
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(tmp.Name())
 
-	wrtr := csv.NewWriter(file)
-	slice := a.slice()
-	return wrtr.WriteAll(slice)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
 // Add takes a ThreemaContact and adds it to the AddressBook
 func (a *AddressBook) Add(c ThreemaContact) {
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+	a.add(c)
+}
+
+// add stores c, recording when a previously unknown contact was first seen
+func (a *AddressBook) add(c ThreemaContact) {
 	id := string(c.ID[:])
-	if a.contacts == nil {
-		a.initializeMap(1)
+	if _, known := a.contacts[id]; !known && c.FirstSeen.IsZero() {
+		c.FirstSeen = time.Now()
 	}
 	a.contacts[id] = c
 }
@@ -117,7 +331,14 @@ func (a *AddressBook) Add(c ThreemaContact) {
 // Get returns a ThreemaContact to a given ID. It returns an empty ThreemaContact
 // if no entry is found. The second parameter can be used to check if
 // retrieval was successful
-func (a AddressBook) Get(id string) (ThreemaContact, bool) {
+func (a *AddressBook) Get(id string) (ThreemaContact, bool) {
+	mu := a.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+	return a.get(id)
+}
+
+func (a *AddressBook) get(id string) (ThreemaContact, bool) {
 	contact := a.contacts[id]
 	//checking if an empty ThreemaContact was returned
 	if bytes.Equal(contact.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
@@ -126,7 +347,101 @@ func (a AddressBook) Get(id string) (ThreemaContact, bool) {
 	return contact, true
 }
 
-// Contacts returns the map of id strings to contact structs of all contacts in the address book
-func (a AddressBook) Contacts() map[string]ThreemaContact {
-	return a.contacts
+// Contacts returns a map of id strings to contact structs of all contacts in the address book.
+// The map is a copy, changes to it do not affect the AddressBook.
+func (a *AddressBook) Contacts() map[string]ThreemaContact {
+	mu := a.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+	contacts := make(map[string]ThreemaContact, len(a.contacts))
+	for id, contact := range a.contacts {
+		contacts[id] = contact
+	}
+	return contacts
+}
+
+// Pin adds c to the AddressBook if its ID is not yet known (trust on first use) and returns the stored
+// contact. If the ID is known with the same public key, its verification level is raised to that of c
+// and a pending KeyChange is dropped, as the key went back to the pinned one. If the ID is known with
+// a different public key the stored contact is left untouched, the conflict is recorded and returned
+// as a KeyChange error. Until the change is accepted using AcceptKeyChange, the session refuses to
+// exchange messages with that contact.
+func (a *AddressBook) Pin(c ThreemaContact) (ThreemaContact, error) {
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	id := string(c.ID[:])
+	pinned, ok := a.get(id)
+	if !ok {
+		a.add(c)
+		return c, nil
+	}
+	if pinned.LPK == c.LPK {
+		delete(a.keyChanges, id)
+		if c.Level > pinned.Level {
+			pinned.Level = c.Level
+			a.contacts[id] = pinned
+		}
+		return pinned, nil
+	}
+
+	kc := KeyChange{
+		ID:     IDString(c.ID),
+		Pinned: pinned.LPK,
+		New:    c.LPK,
+		Level:  pinned.Level}
+	a.keyChanges[id] = kc
+	return pinned, kc
+}
+
+// SetFeatureMask updates the feature mask of a known contact as fetched from the server now. It
+// reports whether the contact was found.
+func (a *AddressBook) SetFeatureMask(id string, fm FeatureMask) bool {
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	contact, ok := a.get(id)
+	if ok {
+		contact.FeatureMask = fm
+		contact.FeatureMaskFetched = time.Now()
+		a.contacts[id] = contact
+	}
+	return ok
+}
+
+// KeyChanged returns the unresolved KeyChange recorded for the given ID, if any
+func (a *AddressBook) KeyChanged(id string) (KeyChange, bool) {
+	mu := a.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+	kc, ok := a.keyChanges[id]
+	return kc, ok
+}
+
+// AcceptKeyChange replaces the pinned public key of the contact with the given ID by the key
+// recorded in its KeyChange. Any previous verification is lost, the contact is considered
+// SERVERFETCHED afterwards.
+func (a *AddressBook) AcceptKeyChange(id string) error {
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+	return a.acceptKeyChange(id)
+}
+
+func (a *AddressBook) acceptKeyChange(id string) error {
+	kc, ok := a.keyChanges[id]
+	if !ok {
+		return fmt.Errorf("no key change recorded for %s", id)
+	}
+	contact, ok := a.get(id)
+	if !ok {
+		contact.ID = kc.ID
+	}
+	contact.LPK = kc.New
+	contact.Level = SERVERFETCHED
+	a.add(contact)
+	delete(a.keyChanges, id)
+	return nil
 }
@@ -0,0 +1,253 @@
+package o3
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPinKeyChange(t *testing.T) {
+	ab := NewAddressBook()
+	first := ThreemaContact{ID: NewIDString("ECHOECHO"), LPK: [32]byte{1}, Level: SERVERFETCHED}
+
+	if _, err := ab.Pin(first); err != nil {
+		t.Fatalf("pinning unknown contact failed: %s", err)
+	}
+	if _, err := ab.Pin(first); err != nil {
+		t.Fatalf("re-pinning identical key failed: %s", err)
+	}
+
+	changed := first
+	changed.LPK = [32]byte{2}
+	pinned, err := ab.Pin(changed)
+	kc, ok := err.(KeyChange)
+	if !ok {
+		t.Fatalf("expected KeyChange, got %v", err)
+	}
+	if pinned.LPK != first.LPK || kc.Pinned != first.LPK || kc.New != changed.LPK {
+		t.Errorf("pinned key was replaced or KeyChange is wrong: %#v", kc)
+	}
+	if _, ok := ab.KeyChanged("ECHOECHO"); !ok {
+		t.Error("key change was not recorded")
+	}
+
+	if err := ab.AcceptKeyChange("ECHOECHO"); err != nil {
+		t.Fatal(err)
+	}
+	contact, _ := ab.Get("ECHOECHO")
+	if contact.LPK != changed.LPK {
+		t.Error("accepted key was not stored")
+	}
+	if _, ok := ab.KeyChanged("ECHOECHO"); ok {
+		t.Error("key change still pending after accepting it")
+	}
+}
+
+func TestVerifyQRPayload(t *testing.T) {
+	tid, err := NewThreemaID("ECHOECHO", [32]byte{42}, AddressBook{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := tid.QRPayload()
+
+	scanned, err := ParseQRPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned.LPK != *tid.GetPubKey() || scanned.String() != "ECHOECHO" {
+		t.Fatalf("payload %q did not round-trip: %#v", payload, scanned)
+	}
+	if scanned.QRPayload() != payload {
+		t.Errorf("contact payload %q differs from ID payload %q", scanned.QRPayload(), payload)
+	}
+
+	ab := NewAddressBook()
+	ab.Add(ThreemaContact{ID: scanned.ID, LPK: scanned.LPK, Level: SERVERFETCHED})
+	contact, err := ab.Verify(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.Level != FULLYVERIFIED {
+		t.Errorf("contact was not raised to FULLYVERIFIED: %d", contact.Level)
+	}
+
+	ab.Add(ThreemaContact{ID: scanned.ID, LPK: [32]byte{1}, Level: SERVERFETCHED})
+	if _, err := ab.Verify(payload); err == nil {
+		t.Error("verifying a mismatching key succeeded")
+	}
+
+	key := strings.Repeat("01", 32)
+	for _, invalid := range []string{"", "3mid:ECHOECHO", "3mid:ECHO,00", "3mid:ECHOECHO,zz", "3mid:echoecho," + key, "3mid:ECHO\x00ECH," + key} {
+		if _, err := ParseQRPayload(invalid); err == nil {
+			t.Errorf("invalid payload %q was accepted", invalid)
+		}
+	}
+}
+
+func TestAddressBookRoundTrip(t *testing.T) {
+	for _, fixture := range []string{"test/idAlice.ab", "test/idBob.ab"} {
+		var legacy AddressBook
+		if err := legacy.ImportFrom(fixture); err != nil {
+			t.Fatalf("%s: %s", fixture, err)
+		}
+		if len(legacy.Contacts()) == 0 {
+			t.Fatalf("%s: no contacts imported", fixture)
+		}
+
+		// migrate the CSV fixture and enrich it with fields the CSV format cannot hold
+		for _, c := range legacy.Contacts() {
+			c.Level = FULLYVERIFIED
+			c.Nickname = "nick " + c.String()
+			c.FeatureMask = 0x0f
+			c.Blocked = true
+			c.FirstSeen = time.Unix(1500000000, 0)
+			legacy.Add(c)
+		}
+		changed := ThreemaContact{ID: NewIDString("ECHOECHO"), LPK: [32]byte{1}}
+		legacy.Add(changed)
+		changed.LPK = [32]byte{2}
+		legacy.Pin(changed)
+
+		filename := filepath.Join(t.TempDir(), "contacts.ab")
+		if err := legacy.SaveTo(filename); err != nil {
+			t.Fatal(err)
+		}
+		var migrated AddressBook
+		if err := migrated.ImportFrom(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		want, got := legacy.Contacts(), migrated.Contacts()
+		if len(want) != len(got) {
+			t.Fatalf("%s: %d contacts saved, %d loaded", fixture, len(want), len(got))
+		}
+		for id, c := range want {
+			g := got[id]
+			if !g.FirstSeen.Equal(c.FirstSeen) {
+				t.Errorf("%s: first seen of %s: want %s, got %s", fixture, id, c.FirstSeen, g.FirstSeen)
+			}
+			g.FirstSeen = c.FirstSeen
+			if g != c {
+				t.Errorf("%s: contact %s did not round-trip:\nwant %#v\ngot  %#v", fixture, id, c, g)
+			}
+		}
+		if kc, ok := migrated.KeyChanged("ECHOECHO"); !ok || kc.New != changed.LPK {
+			t.Errorf("%s: pending key change was not restored", fixture)
+		}
+	}
+}
+
+func TestAddressBookUnsupportedVersion(t *testing.T) {
+	var ab AddressBook
+	if err := ab.UnmarshalJSON([]byte(`{"version": 99, "contacts": []}`)); err == nil {
+		t.Error("address book of unknown version was accepted")
+	}
+}
+
+func TestAddressBookCopiesShareImports(t *testing.T) {
+	ab := NewAddressBook()
+	shared := ab
+	ab.Add(ThreemaContact{ID: NewIDString("OLDCONTA")})
+	if err := ab.Import([][]string{{"ECHOECHO", "Echo", "0101010101010101010101010101010101010101010101010101010101010101"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := shared.Get("ECHOECHO"); !ok {
+		t.Error("imported contact missing from copy")
+	}
+	if _, ok := shared.Get("OLDCONTA"); ok {
+		t.Error("replaced contact still in copy")
+	}
+
+	empty := NewAddressBook()
+	data, err := empty.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ab.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(shared.Contacts()) != 0 {
+		t.Error("copy kept contacts after unmarshaling an empty address book")
+	}
+
+	gb := NewGroupBook()
+	sharedGroups := gb
+	if err := gb.UnmarshalJSON([]byte(`[{"creator": "ECHOECHO", "id": "0102030405060708", "members": ["ECHOECHO"]}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sharedGroups.List()) != 1 {
+		t.Error("unmarshaled group missing from copy")
+	}
+}
+
+func TestImportInvalidIDs(t *testing.T) {
+	key := strings.Repeat("01", 32)
+	for _, id := range []string{"ECHO", "echoecho", "ECHO\x00ECH", "ECHO-ECH"} {
+		ab := NewAddressBook()
+		if err := ab.Import([][]string{{id, "Echo", key}}); err == nil {
+			t.Errorf("import accepted ID %q", id)
+		}
+		data, _ := json.Marshal(addressBookFile{
+			Version:  addressBookVersion,
+			Contacts: []contactRecord{{ID: id, PublicKey: key}}})
+		if err := ab.UnmarshalJSON(data); err == nil {
+			t.Errorf("address book accepted ID %q", id)
+		}
+		if len(ab.Contacts()) != 0 {
+			t.Errorf("contacts added despite ID %q", id)
+		}
+
+		gb := NewGroupBook()
+		data, _ = json.Marshal([]groupRecord{{Creator: id, ID: "0102030405060708"}})
+		if err := gb.UnmarshalJSON(data); err == nil {
+			t.Errorf("group book accepted creator %q", id)
+		}
+		data, _ = json.Marshal([]groupRecord{{Creator: "ECHOECHO", ID: "0102030405060708", Members: []string{id}}})
+		if err := gb.UnmarshalJSON(data); err == nil {
+			t.Errorf("group book accepted member %q", id)
+		}
+	}
+}
+
+func TestPinKeyReverted(t *testing.T) {
+	ab := NewAddressBook()
+	imported := ThreemaContact{ID: NewIDString("ECHOECHO"), LPK: [32]byte{1}, Level: UNVERIFIED}
+	ab.Add(imported)
+
+	changed := imported
+	changed.LPK = [32]byte{2}
+	if _, err := ab.Pin(changed); err == nil {
+		t.Fatal("key change not detected")
+	}
+	// The server returns the pinned key again
+	fetched := imported
+	fetched.Level = SERVERFETCHED
+	pinned, err := ab.Pin(fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ab.KeyChanged("ECHOECHO"); ok {
+		t.Error("stale key change still pending")
+	}
+	if stored, _ := ab.Get("ECHOECHO"); pinned.Level != SERVERFETCHED || stored.Level != SERVERFETCHED {
+		t.Errorf("level not raised: %d", stored.Level)
+	}
+}
+
+func TestZeroBooks(t *testing.T) {
+	var ab AddressBook
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("zero value AddressBook used")
+			}
+		}()
+		ab.Add(ThreemaContact{ID: NewIDString("ECHOECHO")})
+	}()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("TESTSELF")})
+	sc.ID.Contacts.Add(ThreemaContact{ID: NewIDString("ECHOECHO")})
+	sc.ID.Groups.Add(Group{CreatorID: sc.ID.ID, GroupID: [8]byte{1}})
+}
@@ -0,0 +1,287 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// AudioDurationUnknown is the duration of audio messages whose length is not known
+const AudioDurationUnknown = 0xFFFF
+
+// minAudioBitrate is the lowest bitrate in bits per second we expect audio to be encoded with.
+// Received durations that would need a lower one are not believed.
+const minAudioBitrate = 500
+
+var errUnknownAudioFormat = errors.New("unknown audio format")
+
+// audioDuration determines the playing time of MP4/M4A, MP3, ADTS AAC and Ogg Opus or Vorbis
+// audio from its container without decoding it
+func audioDuration(data []byte) (time.Duration, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return oggDuration(data)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return mp4Duration(data)
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return mpegAudioDuration(data)
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		if data[1]&0xF6 == 0xF0 {
+			return adtsDuration(data)
+		}
+		return mpegAudioDuration(data)
+	default:
+		return 0, errUnknownAudioFormat
+	}
+}
+
+// audioDurationSeconds converts d to the duration field of audio messages
+func audioDurationSeconds(d time.Duration) uint16 {
+	secs := (d + time.Second/2) / time.Second
+	switch {
+	case secs < 1:
+		return 1
+	case secs >= AudioDurationUnknown:
+		return AudioDurationUnknown
+	default:
+		return uint16(secs)
+	}
+}
+
+// plausibleAudioDuration reports whether an audio blob of size bytes can play for duration seconds
+func plausibleAudioDuration(duration uint16, size uint32) bool {
+	return duration != 0 && uint64(size)*8 >= uint64(duration)*minAudioBitrate
+}
+
+// mp4Duration reads the duration from the movie header box
+func mp4Duration(data []byte) (time.Duration, error) {
+	moov, ok := mp4Box(data, "moov")
+	if !ok {
+		return 0, errors.New("mp4: no movie box")
+	}
+	mvhd, ok := mp4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 4 {
+		return 0, errors.New("mp4: no movie header")
+	}
+	var timescale uint32
+	var duration uint64
+	switch mvhd[0] {
+	case 0:
+		if len(mvhd) < 20 {
+			return 0, errors.New("mp4: short movie header")
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[12:])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case 1:
+		if len(mvhd) < 32 {
+			return 0, errors.New("mp4: short movie header")
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[20:])
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	default:
+		return 0, errors.New("mp4: unknown movie header version")
+	}
+	if timescale == 0 || duration == 0xFFFFFFFF || duration == 1<<64-1 {
+		return 0, errors.New("mp4: duration not set")
+	}
+	return scaleDuration(duration, uint64(timescale)), nil
+}
+
+// mp4Box returns the content of the first box of the given type in data
+func mp4Box(data []byte, boxType string) ([]byte, bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, false
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, false
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size], true
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
+
+var mpegBitrates = [2][3][15]uint32{
+	// MPEG-1 layer I, II and III
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	// MPEG-2 and 2.5 layer I, II and III
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mpegSampleRates = [4][3]uint32{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+// mpegFrame parses the MPEG audio frame header at the start of data, returning the length of the
+// frame in bytes, the samples it holds and its sample rate
+func mpegFrame(data []byte) (length, samples, rate uint32, ok bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return 0, 0, 0, false
+	}
+	version := data[1] >> 3 & 3
+	layer := 4 - data[1]>>1&3 // 1, 2 or 3, 4 is reserved
+	bitrateIndex := data[2] >> 4
+	rateIndex := data[2] >> 2 & 3
+	padding := uint32(data[2] >> 1 & 1)
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return 0, 0, 0, false
+	}
+	v := 0
+	if version != 3 {
+		v = 1
+	}
+	bitrate := mpegBitrates[v][layer-1][bitrateIndex] * 1000
+	rate = mpegSampleRates[version][rateIndex]
+	switch {
+	case layer == 1:
+		return (12*bitrate/rate + padding) * 4, 384, rate, true
+	case layer == 3 && v == 1:
+		return 72*bitrate/rate + padding, 576, rate, true
+	default:
+		return 144*bitrate/rate + padding, 1152, rate, true
+	}
+}
+
+// mpegAudioDuration adds up the frames of MP3 (or MP2) audio, which works for constant and
+// variable bitrates alike
+func mpegAudioDuration(data []byte) (time.Duration, error) {
+	if len(data) >= 10 && bytes.HasPrefix(data, []byte("ID3")) {
+		// the tag size is stored in four 7 bit bytes, a footer doubles the header
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		size += 10
+		if data[5]&0x10 != 0 {
+			size += 10
+		}
+		if size > len(data) {
+			return 0, errors.New("mp3: truncated ID3 tag")
+		}
+		data = data[size:]
+	}
+	var total time.Duration
+	var frames int
+	for {
+		length, samples, rate, ok := mpegFrame(data)
+		if !ok || int(length) > len(data) {
+			break
+		}
+		total += scaleDuration(uint64(samples), uint64(rate))
+		frames++
+		data = data[length:]
+	}
+	if frames == 0 {
+		return 0, errors.New("mp3: no frames")
+	}
+	return total, nil
+}
+
+var adtsSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsDuration adds up the frames of AAC audio in ADTS framing
+func adtsDuration(data []byte) (time.Duration, error) {
+	var total time.Duration
+	var frames int
+	for len(data) >= 7 && data[0] == 0xFF && data[1]&0xF6 == 0xF0 {
+		rateIndex := int(data[2] >> 2 & 0xF)
+		length := int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		blocks := uint64(data[6]&3) + 1
+		if rateIndex >= len(adtsSampleRates) || length < 7 || length > len(data) {
+			break
+		}
+		total += scaleDuration(blocks*1024, uint64(adtsSampleRates[rateIndex]))
+		frames++
+		data = data[length:]
+	}
+	if frames == 0 {
+		return 0, errors.New("aac: no frames")
+	}
+	return total, nil
+}
+
+// oggDuration reads the granule position of the last page of the first logical stream, which
+// counts the samples played up to its end
+func oggDuration(data []byte) (time.Duration, error) {
+	var serial uint32
+	var rate, preSkip uint64
+	granule := int64(-1)
+	for first := true; len(data) >= 27 && bytes.HasPrefix(data, []byte("OggS")); first = false {
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			break
+		}
+		length := 27 + segments
+		for _, s := range data[27 : 27+segments] {
+			length += int(s)
+		}
+		if length > len(data) {
+			break
+		}
+		pageSerial := binary.LittleEndian.Uint32(data[14:])
+		if first {
+			serial = pageSerial
+			var err error
+			if rate, preSkip, err = oggCodec(data[27+segments : length]); err != nil {
+				return 0, err
+			}
+		}
+		if pos := int64(binary.LittleEndian.Uint64(data[6:])); pageSerial == serial && pos >= 0 {
+			granule = pos
+		}
+		data = data[length:]
+	}
+	if rate == 0 || granule < 0 {
+		return 0, errors.New("ogg: no pages")
+	}
+	if uint64(granule) < preSkip {
+		return 0, nil
+	}
+	return scaleDuration(uint64(granule)-preSkip, rate), nil
+}
+
+// oggCodec returns the granule rate and the samples to skip at the start of an Opus or Vorbis
+// stream starting with the given packet
+func oggCodec(packet []byte) (rate, preSkip uint64, err error) {
+	switch {
+	case len(packet) >= 19 && bytes.HasPrefix(packet, []byte("OpusHead")):
+		// Opus granule positions always count samples at 48 kHz
+		return 48000, uint64(binary.LittleEndian.Uint16(packet[10:])), nil
+	case len(packet) >= 16 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		return uint64(binary.LittleEndian.Uint32(packet[12:])), 0, nil
+	default:
+		return 0, 0, errors.New("ogg: unsupported codec")
+	}
+}
+
+// scaleDuration returns the duration of n units of 1/rate seconds
+func scaleDuration(n, rate uint64) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	if n/rate > 1<<32 {
+		// far beyond what the duration field of audio messages can hold
+		return time.Duration(1<<32) * time.Second
+	}
+	return time.Duration(n/rate)*time.Second + time.Duration(n%rate*uint64(time.Second)/rate)
+}
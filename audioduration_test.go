@@ -0,0 +1,114 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func mp4Atom(boxType string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	atom := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(atom, uint32(8+len(body)))
+	copy(atom[4:], boxType)
+	return append(atom, body...)
+}
+
+func oggPage(serial uint32, granule int64, packet []byte) []byte {
+	page := make([]byte, 27, 28+len(packet))
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	page[26] = 1
+	page = append(page, byte(len(packet)))
+	return append(page, packet...)
+}
+
+func TestAudioDuration(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 44100)
+	binary.BigEndian.PutUint32(mvhd[16:], 44100*83/10)
+	m4a := append(mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00")), mp4Atom("mdat", make([]byte, 64))...)
+	m4a = append(m4a, mp4Atom("moov", mp4Atom("mvhd", mvhd), mp4Atom("trak"))...)
+
+	// 128 kbit/s at 44.1 kHz without padding, 1152 samples per frame
+	mp3 := []byte("ID3\x03\x00\x00\x00\x00\x00\x05tag..")
+	for i := 0; i < 100; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+		mp3 = append(mp3, frame...)
+	}
+	mp3 = append(mp3, []byte("TAG trailing ID3v1")...)
+
+	// 44.1 kHz, one block of 1024 samples per frame
+	var aac []byte
+	for i := 0; i < 431; i++ {
+		frame := make([]byte, 20)
+		copy(frame, []byte{0xFF, 0xF1, 0x50, 0x80, 20 >> 3, (20 & 7) << 5, 0xFC})
+		aac = append(aac, frame...)
+	}
+
+	opusHead := []byte("OpusHead\x01\x01\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	opus := oggPage(7, 0, opusHead)
+	opus = append(opus, oggPage(7, 0, []byte("OpusTags"))...)
+	opus = append(opus, oggPage(9, 48000*60, []byte("other stream"))...)
+	opus = append(opus, oggPage(7, 48000*2, make([]byte, 50))...)
+	opus = append(opus, oggPage(7, 312+48000*5/2, make([]byte, 50))...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want time.Duration
+	}{
+		{"m4a", m4a, 8300 * time.Millisecond},
+		{"mp3", mp3, 100 * 1152 * time.Second / 44100},
+		{"aac", aac, 431 * 1024 * time.Second / 44100},
+		{"opus", opus, 2500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		d, err := audioDuration(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if diff := d - tt.want; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%s: duration %v, want %v", tt.name, d, tt.want)
+		}
+	}
+
+	for _, data := range [][]byte{[]byte("RIFF....WAVE"), m4a[:30], []byte("OggS"), {0xFF, 0xFB}} {
+		if d, err := audioDuration(data); err == nil {
+			t.Errorf("duration %v of %q", d, data)
+		}
+	}
+
+	secs := []struct {
+		d    time.Duration
+		want uint16
+	}{{0, 1}, {1499 * time.Millisecond, 1}, {1500 * time.Millisecond, 2}, {20 * time.Hour, AudioDurationUnknown}}
+	for _, tt := range secs {
+		if got := audioDurationSeconds(tt.d); got != tt.want {
+			t.Errorf("audioDurationSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestAudioDurationSerialization(t *testing.T) {
+	am := AudioMessage{audioMessageBody: audioMessageBody{Duration: 8, Size: 32000, BlobID: [16]byte{1}}}
+	body := am.Serialize()[1:]
+	if d := binary.LittleEndian.Uint16(body); d != 8 {
+		t.Errorf("serialized duration %d", d)
+	}
+	if parsed := parseAudioMessage(bytes.NewBuffer(body)); parsed.Duration != 8 || parsed.Size != 32000 {
+		t.Errorf("parsed %#v", parsed)
+	}
+
+	// 10 kB cannot hold three hours of audio
+	am.Size, am.Duration = 10000, 3*60*60
+	if parsed := parseAudioMessage(bytes.NewBuffer(am.Serialize()[1:])); parsed.Duration != AudioDurationUnknown {
+		t.Errorf("implausible duration %d accepted", parsed.Duration)
+	}
+	am.Duration = 0
+	if parsed := parseAudioMessage(bytes.NewBuffer(am.Serialize()[1:])); parsed.Duration != AudioDurationUnknown {
+		t.Errorf("zero duration accepted")
+	}
+}
@@ -18,8 +18,8 @@ func TestAliceBob(t *testing.T) {
 	wg.Add(2)
 
 	aToBMsg := randString(30)
-	go pingPong(t, &wg, aToBMsg, bobCtx.ID.String(), &aliceCtx)
-	go pingPong(t, &wg, aToBMsg, aliceCtx.ID.String(), &bobCtx)
+	go pingPong(t, &wg, aToBMsg, bobCtx.ID.String(), aliceCtx)
+	go pingPong(t, &wg, aToBMsg, aliceCtx.ID.String(), bobCtx)
 
 	wg.Wait()
 	t.Log("all done!")
@@ -61,7 +61,7 @@ func pingPong(t *testing.T,
 	}
 }
 
-func initSession(t *testing.T, idpath, abpath, pass string) SessionContext {
+func initSession(t *testing.T, idpath, abpath, pass string) *SessionContext {
 	passw, err := base64.StdEncoding.DecodeString(pass)
 	if err != nil {
 		t.Fatal(errors.Wrapf(err, "could not decode id(%s) password", idpath))
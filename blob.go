@@ -2,9 +2,9 @@ package o3
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -12,6 +12,10 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
@@ -19,77 +23,441 @@ import (
 
 var threemaCert = []byte{0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0x42, 0x45, 0x47, 0x49, 0x4e, 0x20, 0x43, 0x45, 0x52, 0x54, 0x49, 0x46, 0x49, 0x43, 0x41, 0x54, 0x45, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0xa, 0x4d, 0x49, 0x49, 0x45, 0x59, 0x54, 0x43, 0x43, 0x41, 0x30, 0x6d, 0x67, 0x41, 0x77, 0x49, 0x42, 0x41, 0x67, 0x49, 0x4a, 0x41, 0x4d, 0x31, 0x44, 0x52, 0x2f, 0x44, 0x42, 0x52, 0x46, 0x70, 0x51, 0x4d, 0x41, 0x30, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x42, 0x42, 0x51, 0x55, 0x41, 0x4d, 0x48, 0x30, 0x78, 0x43, 0x7a, 0x41, 0x4a, 0x42, 0x67, 0x4e, 0x56, 0xa, 0x42, 0x41, 0x59, 0x54, 0x41, 0x6b, 0x4e, 0x49, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x49, 0x45, 0x77, 0x4a, 0x61, 0x53, 0x44, 0x45, 0x50, 0x4d, 0x41, 0x30, 0x47, 0x41, 0x31, 0x55, 0x45, 0x42, 0x78, 0x4d, 0x47, 0x57, 0x6e, 0x56, 0x79, 0x61, 0x57, 0x4e, 0x6f, 0x4d, 0x52, 0x41, 0x77, 0x44, 0x67, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4b, 0x45, 0x77, 0x64, 0x55, 0xa, 0x61, 0x48, 0x4a, 0x6c, 0x5a, 0x57, 0x31, 0x68, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4c, 0x45, 0x77, 0x4a, 0x44, 0x51, 0x54, 0x45, 0x54, 0x4d, 0x42, 0x45, 0x47, 0x41, 0x31, 0x55, 0x45, 0x41, 0x78, 0x4d, 0x4b, 0x56, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x42, 0x44, 0x51, 0x54, 0x45, 0x63, 0x4d, 0x42, 0x6f, 0x47, 0x43, 0x53, 0x71, 0x47, 0xa, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x4a, 0x41, 0x52, 0x59, 0x4e, 0x59, 0x32, 0x46, 0x41, 0x64, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x35, 0x6a, 0x61, 0x44, 0x41, 0x65, 0x46, 0x77, 0x30, 0x78, 0x4d, 0x6a, 0x45, 0x78, 0x4d, 0x54, 0x4d, 0x78, 0x4d, 0x54, 0x55, 0x34, 0x4e, 0x54, 0x68, 0x61, 0x46, 0x77, 0x30, 0x7a, 0x4d, 0x6a, 0x45, 0x78, 0x4d, 0x44, 0x67, 0x78, 0xa, 0x4d, 0x54, 0x55, 0x34, 0x4e, 0x54, 0x68, 0x61, 0x4d, 0x48, 0x30, 0x78, 0x43, 0x7a, 0x41, 0x4a, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x59, 0x54, 0x41, 0x6b, 0x4e, 0x49, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x49, 0x45, 0x77, 0x4a, 0x61, 0x53, 0x44, 0x45, 0x50, 0x4d, 0x41, 0x30, 0x47, 0x41, 0x31, 0x55, 0x45, 0x42, 0x78, 0x4d, 0x47, 0x57, 0x6e, 0x56, 0x79, 0xa, 0x61, 0x57, 0x4e, 0x6f, 0x4d, 0x52, 0x41, 0x77, 0x44, 0x67, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4b, 0x45, 0x77, 0x64, 0x55, 0x61, 0x48, 0x4a, 0x6c, 0x5a, 0x57, 0x31, 0x68, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x4c, 0x45, 0x77, 0x4a, 0x44, 0x51, 0x54, 0x45, 0x54, 0x4d, 0x42, 0x45, 0x47, 0x41, 0x31, 0x55, 0x45, 0x41, 0x78, 0x4d, 0x4b, 0x56, 0x47, 0x68, 0x79, 0xa, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x42, 0x44, 0x51, 0x54, 0x45, 0x63, 0x4d, 0x42, 0x6f, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x4a, 0x41, 0x52, 0x59, 0x4e, 0x59, 0x32, 0x46, 0x41, 0x64, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x53, 0x35, 0x6a, 0x61, 0x44, 0x43, 0x43, 0x41, 0x53, 0x49, 0x77, 0x44, 0x51, 0x59, 0x4a, 0x4b, 0x6f, 0x5a, 0x49, 0xa, 0x68, 0x76, 0x63, 0x4e, 0x41, 0x51, 0x45, 0x42, 0x42, 0x51, 0x41, 0x44, 0x67, 0x67, 0x45, 0x50, 0x41, 0x44, 0x43, 0x43, 0x41, 0x51, 0x6f, 0x43, 0x67, 0x67, 0x45, 0x42, 0x41, 0x4b, 0x38, 0x47, 0x64, 0x6f, 0x54, 0x37, 0x49, 0x70, 0x4e, 0x43, 0x33, 0x44, 0x7a, 0x37, 0x49, 0x55, 0x47, 0x59, 0x57, 0x39, 0x70, 0x4f, 0x42, 0x77, 0x78, 0x2b, 0x39, 0x45, 0x6e, 0x44, 0x5a, 0x72, 0x6b, 0x4e, 0xa, 0x56, 0x44, 0x38, 0x6c, 0x33, 0x4b, 0x66, 0x42, 0x48, 0x6a, 0x47, 0x54, 0x64, 0x69, 0x39, 0x67, 0x51, 0x36, 0x4e, 0x68, 0x2b, 0x6d, 0x51, 0x39, 0x2f, 0x79, 0x51, 0x38, 0x32, 0x35, 0x34, 0x54, 0x32, 0x62, 0x69, 0x67, 0x39, 0x70, 0x30, 0x68, 0x63, 0x6e, 0x38, 0x6b, 0x6a, 0x67, 0x45, 0x51, 0x67, 0x4a, 0x57, 0x48, 0x70, 0x4e, 0x68, 0x59, 0x6e, 0x4f, 0x68, 0x79, 0x33, 0x69, 0x30, 0x6a, 0xa, 0x63, 0x6d, 0x6c, 0x7a, 0x62, 0x31, 0x4d, 0x46, 0x2f, 0x64, 0x65, 0x46, 0x6a, 0x4a, 0x56, 0x74, 0x75, 0x4d, 0x50, 0x33, 0x74, 0x71, 0x54, 0x77, 0x69, 0x4d, 0x61, 0x76, 0x70, 0x77, 0x65, 0x6f, 0x61, 0x32, 0x30, 0x6c, 0x47, 0x44, 0x6e, 0x2f, 0x43, 0x4c, 0x5a, 0x6f, 0x64, 0x75, 0x30, 0x52, 0x61, 0x38, 0x6f, 0x4c, 0x37, 0x38, 0x62, 0x36, 0x46, 0x56, 0x7a, 0x74, 0x4e, 0x6b, 0x57, 0x67, 0xa, 0x50, 0x64, 0x69, 0x57, 0x43, 0x6c, 0x4d, 0x6b, 0x30, 0x4a, 0x50, 0x50, 0x4d, 0x6c, 0x66, 0x4c, 0x45, 0x69, 0x4b, 0x38, 0x68, 0x66, 0x48, 0x45, 0x2b, 0x36, 0x6d, 0x52, 0x56, 0x58, 0x6d, 0x69, 0x31, 0x32, 0x69, 0x74, 0x4b, 0x31, 0x73, 0x65, 0x6d, 0x6d, 0x77, 0x79, 0x48, 0x4b, 0x64, 0x6a, 0x39, 0x66, 0x47, 0x34, 0x58, 0x39, 0x2b, 0x72, 0x51, 0x32, 0x73, 0x4b, 0x75, 0x4c, 0x66, 0x65, 0xa, 0x6a, 0x78, 0x37, 0x75, 0x46, 0x78, 0x6e, 0x41, 0x46, 0x2b, 0x47, 0x69, 0x76, 0x43, 0x75, 0x43, 0x6f, 0x38, 0x78, 0x66, 0x4f, 0x65, 0x73, 0x4c, 0x77, 0x37, 0x32, 0x76, 0x78, 0x2b, 0x57, 0x37, 0x6d, 0x6d, 0x64, 0x59, 0x73, 0x68, 0x67, 0x2f, 0x6c, 0x58, 0x4f, 0x63, 0x71, 0x76, 0x73, 0x7a, 0x51, 0x51, 0x2f, 0x4c, 0x6d, 0x46, 0x45, 0x56, 0x51, 0x59, 0x78, 0x4e, 0x61, 0x65, 0x65, 0x56, 0xa, 0x6e, 0x50, 0x53, 0x41, 0x73, 0x2b, 0x68, 0x74, 0x38, 0x76, 0x55, 0x50, 0x57, 0x34, 0x73, 0x58, 0x39, 0x49, 0x6b, 0x58, 0x4b, 0x56, 0x67, 0x42, 0x4a, 0x64, 0x31, 0x52, 0x31, 0x69, 0x73, 0x55, 0x70, 0x6f, 0x46, 0x36, 0x64, 0x4b, 0x6c, 0x55, 0x65, 0x78, 0x6d, 0x76, 0x4c, 0x78, 0x45, 0x79, 0x66, 0x35, 0x63, 0x43, 0x41, 0x77, 0x45, 0x41, 0x41, 0x61, 0x4f, 0x42, 0x34, 0x7a, 0x43, 0x42, 0xa, 0x34, 0x44, 0x41, 0x64, 0x42, 0x67, 0x4e, 0x56, 0x48, 0x51, 0x34, 0x45, 0x46, 0x67, 0x51, 0x55, 0x77, 0x36, 0x4c, 0x61, 0x43, 0x37, 0x2b, 0x4a, 0x36, 0x32, 0x72, 0x4b, 0x64, 0x61, 0x54, 0x41, 0x33, 0x37, 0x6b, 0x41, 0x59, 0x59, 0x55, 0x62, 0x72, 0x6b, 0x67, 0x77, 0x67, 0x62, 0x41, 0x47, 0x41, 0x31, 0x55, 0x64, 0x49, 0x77, 0x53, 0x42, 0x71, 0x44, 0x43, 0x42, 0x70, 0x59, 0x41, 0x55, 0xa, 0x77, 0x36, 0x4c, 0x61, 0x43, 0x37, 0x2b, 0x4a, 0x36, 0x32, 0x72, 0x4b, 0x64, 0x61, 0x54, 0x41, 0x33, 0x37, 0x6b, 0x41, 0x59, 0x59, 0x55, 0x62, 0x72, 0x6b, 0x69, 0x68, 0x67, 0x59, 0x47, 0x6b, 0x66, 0x7a, 0x42, 0x39, 0x4d, 0x51, 0x73, 0x77, 0x43, 0x51, 0x59, 0x44, 0x56, 0x51, 0x51, 0x47, 0x45, 0x77, 0x4a, 0x44, 0x53, 0x44, 0x45, 0x4c, 0x4d, 0x41, 0x6b, 0x47, 0x41, 0x31, 0x55, 0x45, 0xa, 0x43, 0x42, 0x4d, 0x43, 0x57, 0x6b, 0x67, 0x78, 0x44, 0x7a, 0x41, 0x4e, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x63, 0x54, 0x42, 0x6c, 0x70, 0x31, 0x63, 0x6d, 0x6c, 0x6a, 0x61, 0x44, 0x45, 0x51, 0x4d, 0x41, 0x34, 0x47, 0x41, 0x31, 0x55, 0x45, 0x43, 0x68, 0x4d, 0x48, 0x56, 0x47, 0x68, 0x79, 0x5a, 0x57, 0x56, 0x74, 0x59, 0x54, 0x45, 0x4c, 0x4d, 0x41, 0x6b, 0x47, 0x41, 0x31, 0x55, 0x45, 0xa, 0x43, 0x78, 0x4d, 0x43, 0x51, 0x30, 0x45, 0x78, 0x45, 0x7a, 0x41, 0x52, 0x42, 0x67, 0x4e, 0x56, 0x42, 0x41, 0x4d, 0x54, 0x43, 0x6c, 0x52, 0x6f, 0x63, 0x6d, 0x56, 0x6c, 0x62, 0x57, 0x45, 0x67, 0x51, 0x30, 0x45, 0x78, 0x48, 0x44, 0x41, 0x61, 0x42, 0x67, 0x6b, 0x71, 0x68, 0x6b, 0x69, 0x47, 0x39, 0x77, 0x30, 0x42, 0x43, 0x51, 0x45, 0x57, 0x44, 0x57, 0x4e, 0x68, 0x51, 0x48, 0x52, 0x6f, 0xa, 0x63, 0x6d, 0x56, 0x6c, 0x62, 0x57, 0x45, 0x75, 0x59, 0x32, 0x69, 0x43, 0x43, 0x51, 0x44, 0x4e, 0x51, 0x30, 0x66, 0x77, 0x77, 0x55, 0x52, 0x61, 0x55, 0x44, 0x41, 0x4d, 0x42, 0x67, 0x4e, 0x56, 0x48, 0x52, 0x4d, 0x45, 0x42, 0x54, 0x41, 0x44, 0x41, 0x51, 0x48, 0x2f, 0x4d, 0x41, 0x30, 0x47, 0x43, 0x53, 0x71, 0x47, 0x53, 0x49, 0x62, 0x33, 0x44, 0x51, 0x45, 0x42, 0x42, 0x51, 0x55, 0x41, 0xa, 0x41, 0x34, 0x49, 0x42, 0x41, 0x51, 0x41, 0x52, 0x48, 0x4d, 0x79, 0x49, 0x48, 0x42, 0x44, 0x46, 0x75, 0x6c, 0x2b, 0x68, 0x76, 0x6a, 0x41, 0x43, 0x74, 0x36, 0x72, 0x30, 0x45, 0x41, 0x48, 0x59, 0x77, 0x52, 0x39, 0x47, 0x51, 0x53, 0x67, 0x68, 0x49, 0x51, 0x73, 0x66, 0x48, 0x74, 0x38, 0x63, 0x79, 0x56, 0x63, 0x7a, 0x6d, 0x45, 0x6e, 0x4a, 0x48, 0x39, 0x68, 0x72, 0x76, 0x68, 0x39, 0x51, 0xa, 0x56, 0x69, 0x76, 0x6d, 0x37, 0x6d, 0x72, 0x66, 0x76, 0x65, 0x69, 0x68, 0x6d, 0x4e, 0x58, 0x41, 0x6e, 0x34, 0x57, 0x6c, 0x47, 0x77, 0x51, 0x2b, 0x41, 0x43, 0x75, 0x56, 0x74, 0x54, 0x4c, 0x78, 0x77, 0x38, 0x45, 0x72, 0x62, 0x53, 0x54, 0x37, 0x49, 0x4d, 0x41, 0x4f, 0x78, 0x39, 0x6e, 0x70, 0x48, 0x66, 0x2f, 0x6b, 0x6e, 0x67, 0x6e, 0x5a, 0x34, 0x6e, 0x53, 0x77, 0x55, 0x52, 0x46, 0x39, 0xa, 0x72, 0x43, 0x45, 0x79, 0x48, 0x71, 0x31, 0x37, 0x39, 0x70, 0x4e, 0x58, 0x70, 0x4f, 0x7a, 0x5a, 0x32, 0x35, 0x37, 0x45, 0x35, 0x72, 0x30, 0x61, 0x76, 0x4d, 0x4e, 0x4e, 0x58, 0x58, 0x44, 0x77, 0x75, 0x6c, 0x77, 0x30, 0x33, 0x69, 0x42, 0x45, 0x32, 0x31, 0x65, 0x62, 0x64, 0x30, 0x30, 0x70, 0x47, 0x31, 0x31, 0x47, 0x56, 0x71, 0x2f, 0x49, 0x32, 0x36, 0x73, 0x2b, 0x38, 0x42, 0x6a, 0x6e, 0xa, 0x44, 0x4b, 0x52, 0x50, 0x71, 0x75, 0x4b, 0x72, 0x53, 0x4f, 0x34, 0x2f, 0x6c, 0x75, 0x45, 0x44, 0x76, 0x4c, 0x34, 0x6e, 0x67, 0x69, 0x51, 0x6a, 0x5a, 0x70, 0x33, 0x32, 0x53, 0x39, 0x5a, 0x31, 0x4b, 0x39, 0x73, 0x56, 0x4f, 0x7a, 0x71, 0x74, 0x51, 0x37, 0x49, 0x39, 0x7a, 0x7a, 0x65, 0x55, 0x41, 0x44, 0x6d, 0x33, 0x61, 0x56, 0x61, 0x2f, 0x42, 0x70, 0x61, 0x77, 0x34, 0x69, 0x4d, 0x52, 0xa, 0x31, 0x53, 0x49, 0x37, 0x6f, 0x39, 0x61, 0x4a, 0x59, 0x69, 0x52, 0x69, 0x31, 0x67, 0x78, 0x59, 0x50, 0x32, 0x42, 0x55, 0x41, 0x31, 0x49, 0x46, 0x71, 0x72, 0x38, 0x4e, 0x7a, 0x79, 0x66, 0x47, 0x44, 0x37, 0x74, 0x52, 0x48, 0x64, 0x71, 0x37, 0x62, 0x5a, 0x4f, 0x78, 0x58, 0x41, 0x6c, 0x75, 0x76, 0x38, 0x31, 0x64, 0x63, 0x62, 0x7a, 0x30, 0x53, 0x42, 0x58, 0x38, 0x53, 0x67, 0x56, 0x31, 0xa, 0x34, 0x48, 0x45, 0x4b, 0x63, 0x36, 0x78, 0x4d, 0x41, 0x4e, 0x6e, 0x59, 0x73, 0x2f, 0x61, 0x59, 0x4b, 0x6a, 0x76, 0x6d, 0x50, 0x30, 0x56, 0x70, 0x4f, 0x76, 0x52, 0x55, 0xa, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0x45, 0x4e, 0x44, 0x20, 0x43, 0x45, 0x52, 0x54, 0x49, 0x46, 0x49, 0x43, 0x41, 0x54, 0x45, 0x2d, 0x2d, 0x2d, 0x2d, 0x2d, 0xa}
 
-// uploadBlob Uploads a blob to the threema servers and returns the assigned blob ID
-func uploadBlob(blob []byte) ([16]byte, error) {
-	CAPool := x509.NewCertPool()
-	CAPool.AppendCertsFromPEM(threemaCert)
+// DefaultBlobUploadURL is the URL blobs are uploaded to
+const DefaultBlobUploadURL = "https://upload.blob.threema.ch/upload"
+
+// DefaultBlobDownloadURL is the URL template blobs are downloaded from
+const DefaultBlobDownloadURL = "https://{prefix}.blob.threema.ch/{blobId}"
+
+// DefaultBlobDoneURL is the URL template used to mark blobs as downloaded
+const DefaultBlobDoneURL = "https://{prefix}.blob.threema.ch/{blobId}/done"
+
+// BlobClient uploads and downloads the encrypted blobs of media messages. The zero value talks to
+// the production servers.
+type BlobClient struct {
+	// UploadURL is the URL blobs are posted to. If empty, DefaultBlobUploadURL is used.
+	UploadURL string
+	// DownloadURL is the URL template blobs are downloaded from. {blobId} is replaced by the hex
+	// encoded blob ID and {prefix} by its first byte. If empty, DefaultBlobDownloadURL is used.
+	DownloadURL string
+	// DoneURL is the URL template used by MarkDone, with the same placeholders as DownloadURL. If
+	// empty, DefaultBlobDoneURL is used.
+	DoneURL string
+	// AutoMarkDone makes GetImageData and GetAudioData mark blobs as done once they have been
+	// downloaded and decrypted. Group blobs are left alone as other members still need them.
+	AutoMarkDone bool
+	// Retry controls whether failed transfers are retried
+	Retry RetryPolicy
+	// Client is used for all requests if set, see WithTLSConfig. If nil, a client trusting the
+	// Threema CA is used.
+	Client *http.Client
+	// UserAgent is sent with every request. If empty, DefaultUserAgent is used.
+	UserAgent string
+	// MaxSize is the size limit of blobs in bytes. If zero, DefaultMaxBlobSize is used.
+	MaxSize int64
+	// Progress is called while a blob is transferred with the number of bytes transferred so
+	// far and the total size, which is -1 if unknown. It may be called from another goroutine.
+	Progress func(transferred, total int64)
+	ctx      context.Context
+}
 
-	config := tls.Config{RootCAs: CAPool}
+// NewBlobClient returns a BlobClient using the given upload URL and download URL template
+func NewBlobClient(uploadURL, downloadURL string, client *http.Client) BlobClient {
+	return BlobClient{UploadURL: uploadURL, DownloadURL: downloadURL, Client: client}
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &config,
+// WithContext returns a copy of bc whose requests are bound to ctx
+func (bc BlobClient) WithContext(ctx context.Context) BlobClient {
+	bc.ctx = ctx
+	return bc
+}
+
+// Context returns the context requests of bc are bound to
+func (bc BlobClient) Context() context.Context {
+	if bc.ctx == nil {
+		return context.Background()
 	}
-	client := &http.Client{Transport: tr}
+	return bc.ctx
+}
 
-	var imageBuf bytes.Buffer
-	mulipartWriter := multipart.NewWriter(&imageBuf)
+// WithTLSConfig returns a copy of bc using a new Client with the given TLS configuration. Copies
+// of the result share the client and its connections.
+func (bc BlobClient) WithTLSConfig(cfg *tls.Config) BlobClient {
+	bc.Client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	return bc
+}
 
-	part, err := mulipartWriter.CreateFormFile("blob", "blob.bin")
+func (bc BlobClient) client() *http.Client {
+	if bc.Client != nil {
+		return bc.Client
+	}
+	return threemaClient
+}
 
-	io.Copy(part, bytes.NewReader(blob))
-	mulipartWriter.Close()
+// do sends req with the configured user agent and context
+func (bc BlobClient) do(req *http.Request) (*http.Response, error) {
+	userAgent := bc.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return bc.client().Do(req.WithContext(bc.Context()))
+}
 
-	url := "https://upload.blob.threema.ch/upload"
+// downloadURL returns the URL of the blob with the given ID
+func (bc BlobClient) downloadURL(blobID [16]byte) string {
+	template := bc.DownloadURL
+	if template == "" {
+		template = DefaultBlobDownloadURL
+	}
+	return blobURL(template, blobID)
+}
 
-	req, err := http.NewRequest("POST", url, &imageBuf)
-	if err != nil {
+// blobURL fills in the blob ID placeholders of template
+func blobURL(template string, blobID [16]byte) string {
+	return strings.NewReplacer(
+		"{prefix}", hex.EncodeToString(blobID[:1]),
+		"{blobId}", hex.EncodeToString(blobID[:])).Replace(template)
+}
+
+// Upload uploads a blob and returns the ID assigned by the server
+func (bc BlobClient) Upload(blob []byte) ([16]byte, error) {
+	return bc.UploadFrom(bytes.NewReader(blob), int64(len(blob)))
+}
+
+// UploadFrom uploads size bytes read from r as a blob and returns the ID assigned by the server.
+// If size is negative, r is read until EOF and the upload fails once it exceeds the size limit.
+// Failed uploads are only retried if r is an io.Seeker.
+func (bc BlobClient) UploadFrom(r io.Reader, size int64) ([16]byte, error) {
+	limit := bc.maxSize()
+	if size > limit {
+		return [16]byte{}, BlobTooLarge{Size: size, Limit: limit}
+	}
+
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	var blobID [16]byte
+	attempt := 0
+	err := bc.retry(func() error {
+		attempt++
+		if attempt > 1 {
+			if !seekable {
+				return errors.New("cannot rewind blob for another attempt")
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		var err error
+		blobID, err = bc.uploadOnce(r, size)
+		return err
+	})
+	return blobID, err
+}
+
+// uploadOnce makes a single attempt at uploading a blob
+func (bc BlobClient) uploadOnce(r io.Reader, size int64) ([16]byte, error) {
+	// Encode the multipart envelope up front so the blob itself can be streamed
+	var envelope bytes.Buffer
+	mulipartWriter := multipart.NewWriter(&envelope)
+	if _, err := mulipartWriter.CreateFormFile("blob", "blob.bin"); err != nil {
 		return [16]byte{}, err
 	}
+	header := append([]byte(nil), envelope.Bytes()...)
+	envelope.Reset()
+	mulipartWriter.Close()
+	trailer := envelope.Bytes()
 
-	req.Header.Set("User-Agent", "Threema/2.8")
-	req.Header.Set("Content-Type", mulipartWriter.FormDataContentType())
+	transfer := bc.transfer(r, size)
+	body := io.MultiReader(bytes.NewReader(header), transfer, bytes.NewReader(trailer))
 
-	resp, err := client.Do(req)
+	uploadURL := bc.UploadURL
+	if uploadURL == "" {
+		uploadURL = DefaultBlobUploadURL
+	}
+	req, err := http.NewRequest("POST", uploadURL, ioutil.NopCloser(body))
 	if err != nil {
 		return [16]byte{}, err
 	}
-	if resp.StatusCode != 200 {
-		return [16]byte{}, errors.New("could not load server certificate")
+	if size >= 0 {
+		req.ContentLength = int64(len(header)) + size + int64(len(trailer))
 	}
+	req.Header.Set("Content-Type", mulipartWriter.FormDataContentType())
 
-	blobIDraw, err := ioutil.ReadAll(resp.Body)
+	resp, err := bc.do(req)
+	if terr := transfer.failed(); terr != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return [16]byte{}, terr
+	}
 	if err != nil {
+		return [16]byte{}, transientError{err}
+	}
+	defer resp.Body.Close()
+	if err := statusError("uploading blob", resp); err != nil {
 		return [16]byte{}, err
 	}
 
-	blobIDbytes, err := hex.DecodeString(string(blobIDraw))
+	blobIDraw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
 	if err != nil {
 		return [16]byte{}, err
 	}
+	blobIDbytes, err := hex.DecodeString(strings.TrimSpace(string(blobIDraw)))
+	if err != nil || len(blobIDbytes) != 16 {
+		return [16]byte{}, fmt.Errorf("server returned invalid blob ID %q", blobIDraw)
+	}
 
 	var blobID [16]byte
 	copy(blobID[:], blobIDbytes)
-
 	return blobID, nil
 }
 
-// encryptAsymAndUpload encrypts a blob with recipients PK and the sc owners SK
-func encryptAndUploadAsym(sc SessionContext, plainImage []byte, recipientName string) (blobNonce nonce, ServerID byte, size uint32, blobID [16]byte, err error) {
-	// Get contact public key
-	threemaID := sc.ID
-	recipient, inContacts := threemaID.Contacts.Get(recipientName)
-	if !inContacts {
-		var tr ThreemaRest
-		recipient, err = tr.GetContactByID(NewIDString(recipientName))
+// Download downloads the blob with the given ID
+func (bc BlobClient) Download(blobID [16]byte) ([]byte, error) {
+	var blob bytes.Buffer
+	if _, err := bc.DownloadTo(&blob, blobID); err != nil {
+		return nil, err
+	}
+	return blob.Bytes(), nil
+}
+
+// DownloadTo writes the blob with the given ID to w and returns the number of bytes written. A blob
+// announced to exceed the size limit is rejected before its body is read. Failed downloads are
+// retried as long as nothing has been written to w.
+func (bc BlobClient) DownloadTo(w io.Writer, blobID [16]byte) (int64, error) {
+	var n int64
+	err := bc.retry(func() error {
+		var err error
+		n, err = bc.downloadOnce(w, blobID)
+		if n > 0 {
+			return permanent(err)
+		}
+		return err
+	})
+	return n, err
+}
+
+// downloadOnce makes a single attempt at downloading a blob
+func (bc BlobClient) downloadOnce(w io.Writer, blobID [16]byte) (int64, error) {
+	req, err := http.NewRequest("GET", bc.downloadURL(blobID), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := bc.do(req)
+	if err != nil {
+		return 0, transientError{err}
+	}
+	defer resp.Body.Close()
+	if err := statusError("downloading blob", resp); err != nil {
+		return 0, err
+	}
+	if limit := bc.maxSize(); resp.ContentLength > limit {
+		return 0, BlobTooLarge{Size: resp.ContentLength, Limit: limit}
+	}
+
+	transfer := bc.transfer(resp.Body, resp.ContentLength)
+	n, err := io.Copy(w, transfer)
+	if terr := transfer.failed(); terr != nil {
+		return n, terr
+	}
+	if err != nil {
+		return n, transientError{err}
+	}
+	return n, nil
+}
+
+// MarkDone tells the server that the blob with the given ID has been downloaded and is no longer
+// needed
+func (bc BlobClient) MarkDone(blobID [16]byte) error {
+	template := bc.DoneURL
+	if template == "" {
+		template = DefaultBlobDoneURL
+	}
+	return bc.retry(func() error {
+		req, err := http.NewRequest("POST", blobURL(template, blobID), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := bc.do(req)
 		if err != nil {
-			return nonce{}, 0, 0, [16]byte{}, err
+			return transientError{err}
+		}
+		resp.Body.Close()
+		return statusError("marking blob done", resp)
+	})
+}
+
+// RetryPolicy controls how often failed blob transfers are retried. Transfers are retried after
+// network errors and server errors (5xx), not after the server rejected the request. The zero value
+// disables retries.
+type RetryPolicy struct {
+	Attempts int           // the number of attempts, including the first
+	Backoff  time.Duration // the delay before the first retry, doubled for each further one
+}
+
+// transientError marks errors of a transfer that may succeed if retried
+type transientError struct {
+	err error
+}
+
+func (te transientError) Error() string {
+	return te.err.Error()
+}
+
+// permanent strips the transient mark from err
+func permanent(err error) error {
+	if te, ok := err.(transientError); ok {
+		return te.err
+	}
+	return err
+}
+
+// statusError returns an error unless resp reports success. Server errors are transient.
+func statusError(action string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("%s failed: %s", action, resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return transientError{err}
+	}
+	return err
+}
+
+// retry calls attempt until it succeeds, fails permanently or the retry policy is exhausted
+func (bc BlobClient) retry(attempt func() error) error {
+	delay := bc.Retry.Backoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if _, transient := err.(transientError); !transient || i >= bc.Retry.Attempts {
+			return permanent(err)
 		}
+		select {
+		case <-time.After(delay):
+		case <-bc.Context().Done():
+			return permanent(err)
+		}
+		delay *= 2
+	}
+}
+
+// DefaultMaxBlobSize is the size limit of blobs if BlobClient.MaxSize is not set
+const DefaultMaxBlobSize = 50 << 20
+
+// BlobTooLarge is returned when a blob exceeds the size limit of a BlobClient
+type BlobTooLarge struct {
+	Size  int64 // the size of the blob, or the number of bytes read before giving up
+	Limit int64
+}
+
+func (btl BlobTooLarge) Error() string {
+	return fmt.Sprintf("blob of %d bytes exceeds the limit of %d bytes", btl.Size, btl.Limit)
+}
+
+func (bc BlobClient) maxSize() int64 {
+	if bc.MaxSize <= 0 {
+		return DefaultMaxBlobSize
+	}
+	return bc.MaxSize
+}
+
+// blobTransfer reports the progress of reading a blob and stops once it exceeds the size limit.
+// Uploads are read by the HTTP transport, hence err is guarded by mu.
+type blobTransfer struct {
+	r        io.Reader
+	n, total int64
+	limit    int64
+	progress func(transferred, total int64)
+	mu       sync.Mutex
+	err      error
+}
+
+func (bc BlobClient) transfer(r io.Reader, total int64) *blobTransfer {
+	return &blobTransfer{r: r, total: total, limit: bc.maxSize(), progress: bc.Progress}
+}
+
+// failed returns the error that stopped the transfer, if any
+func (bt *blobTransfer) failed() error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.err
+}
+
+func (bt *blobTransfer) Read(p []byte) (int, error) {
+	if err := bt.failed(); err != nil {
+		return 0, err
+	}
+	n, err := bt.r.Read(p)
+	bt.n += int64(n)
+	if bt.n > bt.limit {
+		bt.mu.Lock()
+		bt.err = BlobTooLarge{Size: bt.n, Limit: bt.limit}
+		bt.mu.Unlock()
+		return 0, bt.err
+	}
+	if n > 0 && bt.progress != nil {
+		bt.progress(bt.n, bt.total)
+	}
+	return n, err
+}
+
+// readFile reads a file to be encrypted into a blob, checking its size before reading it
+func (bc BlobClient) readFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if limit := bc.maxMediaSize(); fi.Size() > limit {
+		return nil, BlobTooLarge{Size: fi.Size(), Limit: limit}
+	}
+	return bc.readMedia(f)
+}
+
+// readMedia reads media to be encrypted into a blob from r, giving up once it exceeds the size limit
+func (bc BlobClient) readMedia(r io.Reader) ([]byte, error) {
+	limit := bc.maxMediaSize()
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, BlobTooLarge{Size: int64(len(data)), Limit: limit}
+	}
+	return data, nil
+}
+
+// maxMediaSize is the size limit of media before encryption. The box and secretbox overhead are the
+// same.
+func (bc BlobClient) maxMediaSize() int64 {
+	return bc.maxSize() - secretbox.Overhead
+}
+
+// encryptAsymAndUpload encrypts a blob with recipients PK and the sc owners SK
+func encryptAndUploadAsym(sc *SessionContext, plainImage []byte, recipientName string) (blobNonce nonce, ServerID byte, size uint32, blobID [16]byte, err error) {
+	// Get contact public key
+	recipient, err := sc.lookupContact(NewIDString(recipientName))
+	if err != nil {
+		return nonce{}, 0, 0, [16]byte{}, err
 	}
 
 	blobNonce = newRandomNonce()
-	ciphertext := box.Seal(nil, plainImage, blobNonce.bytes(), &recipient.LPK, &threemaID.LSK)
+	ciphertext := box.Seal(nil, plainImage, blobNonce.bytes(), &recipient.LPK, &sc.ID.LSK)
 
-	blobID, err = uploadBlob(ciphertext)
+	blobID, err = sc.Blobs.Upload(ciphertext)
 	if err != nil {
 		return nonce{}, 0, 0, [16]byte{}, err
 	}
@@ -98,7 +466,7 @@ func encryptAndUploadAsym(sc SessionContext, plainImage []byte, recipientName st
 }
 
 // encryptAsymAndUpload encrypts a blob with recipients PK and the sc owners SK
-func encryptAndUploadSym(plainImage []byte) (key [32]byte, ServerID byte, size uint32, blobID [16]byte, err error) {
+func encryptAndUploadSym(sc *SessionContext, plainImage []byte) (key [32]byte, ServerID byte, size uint32, blobID [16]byte, err error) {
 	// fixed nonce of the form [000000....1]
 	nonce := [24]byte{}
 	nonce[23] = 1
@@ -111,70 +479,30 @@ func encryptAndUploadSym(plainImage []byte) (key [32]byte, ServerID byte, size u
 	}
 	ciphertext := secretbox.Seal(nil, plainImage, &nonce, sharedKey)
 
-	blobID, err = uploadBlob(ciphertext)
+	blobID, err = sc.Blobs.Upload(ciphertext)
 	if err != nil {
 		return [32]byte{}, 0, 0, [16]byte{}, err
 	}
+	if sc.BlobCache != nil {
+		// The cache only saves downloads, failing to fill it is not worth an error
+		sc.BlobCache.put(blobID, secretboxSecret(*sharedKey), plainImage)
+	}
 
 	return *sharedKey, blobID[0], uint32(len(ciphertext)), blobID, nil
 }
 
-//
-func downloadBlob(blobID [16]byte) ([]byte, error) {
-	CAPool := x509.NewCertPool()
-	CAPool.AppendCertsFromPEM(threemaCert)
-
-	config := tls.Config{RootCAs: CAPool}
-
-	tr := &http.Transport{
-		TLSClientConfig: &config,
-	}
-	client := &http.Client{Transport: tr}
-
-	url := fmt.Sprintf("https://%.2x.blob.threema.ch/%x", blobID[0], blobID)
-
-	req, err := http.NewRequest("GET", url, nil)
+func downloadAndDecryptAsym(sc *SessionContext, blobID [16]byte, senderName string, blobNonce nonce) (plaintext []byte, err error) {
+	ciphertext, err := sc.Blobs.Download(blobID)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	req.Header.Set("User-Agent", "Threema/2.8")
-
-	resp, err := client.Do(req)
+	sender, err := sc.lookupContact(NewIDString(senderName))
 	if err != nil {
 		return []byte{}, err
 	}
-	if resp.StatusCode != 200 {
-		return []byte{}, fmt.Errorf("Downloading blob failed: %s", resp.Status)
-	}
-
-	defer resp.Body.Close()
-	ciphertext, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return ciphertext, nil
-}
-
-func downloadAndDecryptAsym(sc SessionContext, blobID [16]byte, senderName string, blobNonce nonce) (plaintext []byte, err error) {
-	ciphertext, err := downloadBlob(blobID)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	var sender ThreemaContact
-	threemaID := sc.ID
-	sender, inContacts := threemaID.Contacts.Get(senderName)
-	if !inContacts {
-		var tr ThreemaRest
-		sender, err = tr.GetContactByID(NewIDString(senderName))
-		if err != nil {
-			return []byte{}, err
-		}
-	}
 
-	plainPicture, success := box.Open(nil, ciphertext, blobNonce.bytes(), &sender.LPK, &threemaID.LSK)
+	plainPicture, success := box.Open(nil, ciphertext, blobNonce.bytes(), &sender.LPK, &sc.ID.LSK)
 	if !success {
 		return []byte{}, errors.New("could not decrypt image message")
 	}
@@ -182,8 +510,8 @@ func downloadAndDecryptAsym(sc SessionContext, blobID [16]byte, senderName strin
 	return plainPicture, nil
 }
 
-func downloadAndDecryptSym(blobID [16]byte, key [32]byte) (plaintext []byte, err error) {
-	ciphertext, err := downloadBlob(blobID)
+func downloadAndDecryptSym(bc BlobClient, blobID [16]byte, key [32]byte) (plaintext []byte, err error) {
+	ciphertext, err := bc.Download(blobID)
 	if err != nil {
 		return []byte{}, err
 	}
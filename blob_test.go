@@ -0,0 +1,379 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeBlobServer stands in for the blob servers, serving uploads at /upload, downloads at
+// /<prefix>/<blob ID> and done marks at /<prefix>/<blob ID>/done. The next failures requests are
+// answered with 503.
+type fakeBlobServer struct {
+	mu       sync.Mutex
+	blobs    map[string][]byte
+	failures int
+}
+
+func (fb *fakeBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if r.UserAgent() != "o3-test" {
+		http.Error(w, "unexpected user agent", http.StatusForbidden)
+		return
+	}
+	if fb.failures > 0 {
+		fb.failures--
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/upload" {
+		f, _, err := r.FormFile("blob")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		var id [16]byte
+		rand.Read(id[:])
+		fb.blobs[hex.EncodeToString(id[:])] = data
+		fmt.Fprint(w, hex.EncodeToString(id[:]))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	data, ok := fb.blobs[parts[1]]
+	if len(parts) > 3 || !ok || !strings.HasPrefix(parts[1], parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 3 {
+		if parts[2] != "done" || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		delete(fb.blobs, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Write(data)
+}
+
+func TestBlobClient(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewTLSServer(fb)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	bc := BlobClient{
+		UploadURL:   srv.URL + "/upload",
+		DownloadURL: srv.URL + "/{prefix}/{blobId}",
+		UserAgent:   "o3-test"}.WithTLSConfig(&tls.Config{RootCAs: pool})
+
+	newSession := func(id string) (*SessionContext, *[32]byte) {
+		pk, sk, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := NewSessionContext(ThreemaID{ID: NewIDString(id), LSK: *sk, Contacts: NewAddressBook()})
+		sc.Blobs = bc
+		return sc, pk
+	}
+	alice, alicePK := newSession("ALICE001")
+	bob, bobPK := newSession("BOB00001")
+	alice.ID.Contacts.Add(ThreemaContact{ID: bob.ID.ID, LPK: *bobPK})
+	bob.ID.Contacts.Add(ThreemaContact{ID: alice.ID.ID, LPK: *alicePK})
+
+	filename := filepath.Join(t.TempDir(), "picture.jpg")
+	content := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00 not really a JPEG")
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := NewImageMessage(alice, "BOB00001", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.blobs) != 1 {
+		t.Fatalf("server has %d blobs", len(fb.blobs))
+	}
+	if plain, err := im.GetImageData(bob); err != nil || !bytes.Equal(plain, content) {
+		t.Errorf("image data: %q, %v", plain, err)
+	}
+
+	var gim GroupImageMessage
+	if err := gim.SetImageData(filename, alice); err != nil {
+		t.Fatal(err)
+	}
+	if gim.ServerID != gim.BlobID[0] || int(gim.Size) != len(fb.blobs[hex.EncodeToString(gim.BlobID[:])]) {
+		t.Errorf("unexpected blob info %x/%d", gim.ServerID, gim.Size)
+	}
+	if plain, err := gim.GetImageData(bob); err != nil || !bytes.Equal(plain, content) {
+		t.Errorf("group image data: %q, %v", plain, err)
+	}
+
+	if _, err := bc.Download([16]byte{1}); err == nil {
+		t.Error("unknown blob downloaded")
+	}
+	bc.UserAgent = ""
+	if _, err := bc.Upload(content); err == nil {
+		t.Error("upload with default user agent accepted")
+	}
+	if _, err := NewBlobClient(srv.URL+"/upload", "", nil).Upload(content); err == nil {
+		t.Error("upload to server with untrusted certificate succeeded")
+	}
+}
+
+func TestBlobDownloadURL(t *testing.T) {
+	id := [16]byte{0xab, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 0xff}
+	if url := (BlobClient{}).downloadURL(id); url != "https://ab.blob.threema.ch/ab0102030405060708090a0b0c0d0eff" {
+		t.Errorf("default download URL %s", url)
+	}
+}
+
+func TestBlobStreaming(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var transferred, total int64
+	bc := NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	bc.UserAgent = "o3-test"
+	bc.MaxSize = 1 << 16
+	bc.Progress = func(n, size int64) {
+		mu.Lock()
+		transferred, total = n, size
+		mu.Unlock()
+	}
+
+	blob := make([]byte, 40000)
+	rand.Read(blob)
+	id, err := bc.UploadFrom(ioutil.NopCloser(bytes.NewReader(blob)), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if transferred != int64(len(blob)) || total != -1 {
+		t.Errorf("upload progress %d/%d", transferred, total)
+	}
+	mu.Unlock()
+
+	var out bytes.Buffer
+	if n, err := bc.DownloadTo(&out, id); err != nil || n != int64(len(blob)) || !bytes.Equal(out.Bytes(), blob) {
+		t.Fatalf("downloaded %d bytes: %v", n, err)
+	}
+	mu.Lock()
+	if transferred != int64(len(blob)) || total != int64(len(blob)) {
+		t.Errorf("download progress %d/%d", transferred, total)
+	}
+	mu.Unlock()
+
+	large := make([]byte, bc.MaxSize+1)
+	if _, err := bc.Upload(large); err == nil {
+		t.Error("blob exceeding the limit uploaded")
+	} else if _, ok := err.(BlobTooLarge); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := bc.UploadFrom(bytes.NewReader(large), -1); err == nil {
+		t.Error("stream exceeding the limit uploaded")
+	} else if _, ok := err.(BlobTooLarge); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(fb.blobs) != 1 {
+		t.Errorf("server has %d blobs", len(fb.blobs))
+	}
+
+	bc.MaxSize = 1000
+	if _, err := bc.DownloadTo(ioutil.Discard, id); err == nil {
+		t.Error("blob exceeding the limit downloaded")
+	} else if btl, ok := err.(BlobTooLarge); !ok || btl.Size != int64(len(blob)) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "large.jpg")
+	if err := ioutil.WriteFile(filename, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var gim GroupImageMessage
+	sc := &SessionContext{Blobs: bc}
+	if err := gim.SetImageData(filename, sc); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("unexpected error for large image: %v", err)
+	}
+}
+
+func TestBlobRetryAndDone(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	bc := NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	bc.DoneURL = srv.URL + "/{prefix}/{blobId}/done"
+	bc.UserAgent = "o3-test"
+
+	fb.failures = 1
+	if _, err := bc.Upload([]byte("blob")); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("upload without retries: %v", err)
+	}
+
+	bc.Retry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	fb.failures = 2
+	id, err := bc.Upload([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.failures = 2
+	if blob, err := bc.Download(id); err != nil || string(blob) != "blob" {
+		t.Fatalf("download with retries: %q, %v", blob, err)
+	}
+	fb.failures = 3
+	if _, err := bc.Download(id); err == nil {
+		t.Error("download succeeded after the retries were used up")
+	}
+	fb.failures = 0
+	if _, err := bc.Download([16]byte{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("unexpected error for unknown blob: %v", err)
+	}
+
+	stream := strings.NewReader("streamed")
+	fb.failures = 1
+	if _, err := bc.UploadFrom(ioutil.NopCloser(stream), -1); err == nil {
+		t.Error("unseekable stream uploaded twice")
+	}
+
+	if err := bc.MarkDone(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.Download(id); err == nil {
+		t.Error("blob still available after marking it done")
+	}
+	if err := bc.MarkDone(id); err == nil {
+		t.Error("unknown blob marked done")
+	}
+
+	// Decrypting an audio message marks its blob done
+	bc.AutoMarkDone = true
+	sc := &SessionContext{Blobs: bc}
+	filename := filepath.Join(t.TempDir(), "audio.m4a")
+	if err := ioutil.WriteFile(filename, []byte("ID3 not really audio"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var am AudioMessage
+	if err := am.SetAudioData(filename, sc); err != nil {
+		t.Fatal(err)
+	}
+	if audio, err := am.GetAudioData(sc); err != nil || string(audio) != "ID3 not really audio" {
+		t.Fatalf("audio data: %q, %v", audio, err)
+	}
+	if _, ok := fb.blobs[hex.EncodeToString(am.BlobID[:])]; ok {
+		t.Error("audio blob not marked done")
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	key := [32]byte{1, 2, 3}
+	cache, err := NewBlobCache(dir, 0, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	bc.UserAgent = "o3-test"
+	sc := &SessionContext{Blobs: bc, BlobCache: cache}
+
+	filename := filepath.Join(t.TempDir(), "audio.m4a")
+	content := []byte("ID3 audio that should not be stored in the clear")
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var first, second AudioMessage
+	if err := first.SetAudioData(filename, sc); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetAudioData(filename, sc); err != nil {
+		t.Fatal(err)
+	}
+	// Every message gets its own blob and key, recipients must not be able to read each other's
+	if len(fb.blobs) != 2 || first.BlobID == second.BlobID || first.Key == second.Key {
+		t.Errorf("identical audio shares a blob: %d uploads", len(fb.blobs))
+	}
+
+	// Media is served from the cache once the server forgot about it
+	fb.blobs = make(map[string][]byte)
+	if audio, err := second.GetAudioData(sc); err != nil || !bytes.Equal(audio, content) {
+		t.Fatalf("cached audio: %q, %v", audio, err)
+	}
+	forged := second
+	forged.Key = [32]byte{}
+	if _, err := forged.GetAudioData(sc); err == nil {
+		t.Error("cached audio returned for the wrong key")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(f)
+		if bytes.Contains(data, content) || bytes.Contains(data, first.Key[:]) {
+			t.Errorf("%s is not encrypted", f)
+		}
+	}
+
+	// A cache without the key cannot read the entries
+	other, _ := NewBlobCache(dir, 0, nil)
+	if _, ok := other.get(first.BlobID, secretboxSecret(first.Key)); ok {
+		t.Error("encrypted entry read without the key")
+	}
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, 2500, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := make([]byte, 1000)
+	ids := [][16]byte{{1}, {2}, {3}}
+	for i, id := range ids {
+		if err := cache.put(id, [32]byte{}, media); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(time.Duration(i-len(ids)) * time.Minute)
+		os.Chtimes(cache.blobPath(id), old, old)
+		if i == 1 {
+			// Using the first entry makes the second the least recently used one
+			if _, ok := cache.get(ids[0], [32]byte{}); !ok {
+				t.Fatal("entry missing")
+			}
+		}
+	}
+	if err := cache.put([16]byte{4}, [32]byte{}, media); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if _, ok := cache.get([16]byte{byte(i + 1)}, [32]byte{}); ok != want {
+			t.Errorf("entry %d cached: %v", i+1, ok)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package o3
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// BlobCache stores decrypted media on disk keyed by blob ID, so media can be read again without
+// downloading it. Media we upload is stored as well. It is safe for concurrent use.
+type BlobCache struct {
+	dir     string
+	maxSize int64
+	key     *[32]byte
+	mu      sync.Mutex
+}
+
+// NewBlobCache returns a BlobCache storing its entries in dir, which is created if necessary. Once
+// the entries exceed maxSize bytes the least recently used ones are removed, a maxSize of zero
+// disables eviction. If key is not nil, entries are encrypted with it.
+func NewBlobCache(dir string, maxSize int64, key *[32]byte) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &BlobCache{dir: dir, maxSize: maxSize, key: key}, nil
+}
+
+func (c *BlobCache) blobPath(blobID [16]byte) string {
+	return filepath.Join(c.dir, "b-"+hex.EncodeToString(blobID[:]))
+}
+
+// get returns the decrypted media of the blob with the given ID if it is cached. secret is a hash of
+// what was needed to decrypt the blob, so media is only returned to those able to decrypt it.
+func (c *BlobCache) get(blobID [16]byte, secret [32]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.read(c.blobPath(blobID))
+	if !ok || len(entry) < len(secret) || subtle.ConstantTimeCompare(entry[:len(secret)], secret[:]) != 1 {
+		return nil, false
+	}
+	return entry[len(secret):], true
+}
+
+// put stores the decrypted media of the blob with the given ID
+func (c *BlobCache) put(blobID [16]byte, secret [32]byte, media []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(c.blobPath(blobID), append(secret[:], media...))
+}
+
+// Remove drops the blob with the given ID from the cache
+func (c *BlobCache) Remove(blobID [16]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := os.Remove(c.blobPath(blobID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// read returns the content of an entry and marks it as recently used. Entries that cannot be
+// decrypted are removed.
+func (c *BlobCache) read(path string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if c.key != nil {
+		var n [24]byte
+		if len(data) < len(n) {
+			os.Remove(path)
+			return nil, false
+		}
+		copy(n[:], data)
+		plain, ok := secretbox.Open(nil, data[len(n):], &n, c.key)
+		if !ok {
+			os.Remove(path)
+			return nil, false
+		}
+		data = plain
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// write stores an entry and evicts old entries if the cache grew too large
+func (c *BlobCache) write(path string, data []byte) error {
+	if c.key != nil {
+		var n [24]byte
+		if _, err := rand.Read(n[:]); err != nil {
+			return err
+		}
+		data = secretbox.Seal(n[:], data, &n, c.key)
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits into maxSize
+func (c *BlobCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var entries []os.FileInfo
+	var total int64
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), "b-") {
+			entries = append(entries, fi)
+			total += fi.Size()
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, fi := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// cachedMedia returns the media of the blob with the given ID from the cache of sc, or fetches and
+// caches it if missing. secret is a hash of the key material the blob is encrypted with.
+func (sc *SessionContext) cachedMedia(blobID [16]byte, secret [32]byte, fetch func() ([]byte, error)) ([]byte, error) {
+	if sc.BlobCache != nil {
+		if media, ok := sc.BlobCache.get(blobID, secret); ok {
+			return media, nil
+		}
+	}
+	media, err := fetch()
+	if err == nil && sc.BlobCache != nil {
+		// The cache only saves downloads, failing to fill it is not worth an error
+		sc.BlobCache.put(blobID, secret, media)
+	}
+	return media, err
+}
+
+// boxSecret identifies what is needed to decrypt a blob encrypted for us by sender
+func boxSecret(sender IDString, n nonce) [32]byte {
+	return sha256.Sum256(append(append([]byte("box"), sender[:]...), n.byteSlice()...))
+}
+
+// secretboxSecret identifies what is needed to decrypt a blob encrypted with key
+func secretboxSecret(key [32]byte) [32]byte {
+	return sha256.Sum256(append([]byte("secretbox"), key[:]...))
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -100,6 +101,14 @@ func (sc *SessionContext) Run() (chan<- Message, <-chan ReceivedMsg, error) {
 	return sc.sendMsgChan.In, sc.receiveMsgChan.Out, nil
 }
 
+// reportError passes err on to ErrorChan without ever blocking the session
+func (sc *SessionContext) reportError(err error) {
+	select {
+	case sc.ErrorChan <- err:
+	default:
+	}
+}
+
 func (sc *SessionContext) receiveLoop() {
 	defer sc.connection.Close()
 	//recv:
@@ -123,11 +132,24 @@ func (sc *SessionContext) receiveLoop() {
 			// Get the actual message
 			var rmsg ReceivedMsg
 			rmsg.Msg, rmsg.Err = sc.handleMessagePacket(pkt)
+			if rmsg.Err == nil {
+				sc.recordMessage(rmsg.Msg)
+			}
 			sc.receiveMsgChan.In <- rmsg
+		case refusedMsgPacket:
+			// Acknowledge it anyway, otherwise the server delivers it again on every connect. A
+			// failed key lookup is left unacknowledged, it may succeed on the next connect.
+			if !pkt.retry {
+				sc.dispatchAckMsg(sc.connection, pkt.messagePacket)
+			}
+			sc.receiveMsgChan.In <- ReceivedMsg{Err: pkt.err}
+		case blockedMsgPacket:
+			// Acknowledge and drop it, the server must not deliver it again
+			sc.dispatchAckMsg(sc.connection, pkt.messagePacket)
 		case ackPacket:
 			// ok cool. nothing to do.
 		case echoPacket:
-			sc.echoCounter = pkt.Counter
+			atomic.StoreUint64(&sc.echoCounter, pkt.Counter)
 		case connEstPacket:
 			//Info.Printf("Got Message: %#v\n", pkt)
 			go sc.sendLoop()
@@ -159,7 +181,7 @@ func (sc *SessionContext) sendLoop() {
 		timeChan := time.Tick(3 * time.Minute)
 		for range timeChan {
 			ep := echoPacket{PktType: echoMsg,
-				Counter: sc.echoCounter}
+				Counter: atomic.LoadUint64(&sc.echoCounter)}
 			echoPktChan <- ep
 		}
 	}()
@@ -167,7 +189,12 @@ func (sc *SessionContext) sendLoop() {
 	for {
 		select {
 		case msg := <-sc.sendMsgChan.Out:
-			sc.dispatchMessage(sc.connection, msg)
+			if err := sc.dispatchMessage(sc.connection, msg); err != nil {
+				// a single refused recipient must not stop the session from sending
+				sc.reportError(err)
+				continue
+			}
+			sc.recordMessage(msg)
 		// Read from echo channel and dispatch (happens every 3 min)
 		case echoPkt := <-echoPktChan:
 			sc.dispatchEchoMsg(sc.connection, echoPkt)
@@ -210,6 +237,16 @@ func (sc *SessionContext) SendImageMessage(recipient string, filename string, se
 // Enqueued messages will be received, not acknowledged and discarded
 // Works with various audio formats threema uses some kind of mp4 but mp3 works fine
 func (sc *SessionContext) SendAudioMessage(recipient string, filename string, sendMsgChan chan<- Message) error {
+	recipientID, err := ParseIDString(recipient)
+	if err != nil {
+		return err
+	}
+	if ok, err := sc.supports(recipientID, FEATUREAUDIO); err != nil {
+		return err
+	} else if !ok {
+		return UnsupportedFeature{ID: recipientID, Feature: FEATUREAUDIO}
+	}
+
 	// build a message
 	am, err := NewAudioMessage(sc, recipient, filename)
 
@@ -222,8 +259,12 @@ func (sc *SessionContext) SendAudioMessage(recipient string, filename string, se
 	return nil
 }
 
-// SendGroupTextMessage Sends a text message to all members
+// SendGroupTextMessage Sends a text message to all members. If the client of a member does not
+// support groups, nothing is sent and UnsupportedFeature is returned.
 func (sc *SessionContext) SendGroupTextMessage(group Group, text string, sendMsgChan chan<- Message) (err error) {
+	if err := sc.supportsGroups(group); err != nil {
+		return err
+	}
 
 	tms, err := NewGroupTextMessages(sc, group, text)
 	if err != nil {
@@ -236,28 +277,65 @@ func (sc *SessionContext) SendGroupTextMessage(group Group, text string, sendMsg
 	return nil
 }
 
-// CreateNewGroup Creates a new group and notifies all members
+// SendGroupImageMessage sends an image to all members, it is uploaded once for all of them. If the
+// client of a member does not support groups, nothing is sent and UnsupportedFeature is returned.
+func (sc *SessionContext) SendGroupImageMessage(group Group, filename string, sendMsgChan chan<- Message) (err error) {
+	if err := sc.supportsGroups(group); err != nil {
+		return err
+	}
+
+	gims, err := NewGroupImageMessages(sc, group, filename)
+	if err != nil {
+		return err
+	}
+	for _, msg := range gims {
+		sendMsgChan <- msg
+	}
+
+	return nil
+}
+
+// SetGroupImage Sends a message with the new group image to all members
+func (sc *SessionContext) SetGroupImage(group Group, filename string, sendMsgChan chan<- Message) (err error) {
+
+	sgi, err := NewGroupManageSetImageMessages(sc, group, filename)
+	if err != nil {
+		return err
+	}
+	for _, msg := range sgi {
+		sendMsgChan <- msg
+	}
+
+	return nil
+}
+
+// CreateNewGroup Creates a new group, notifies all members and adds it to the ID's Groups
 func (sc *SessionContext) CreateNewGroup(group Group, sendMsgChan chan<- Message) (groupID [8]byte, err error) {
 
 	group.GroupID = NewGrpID()
 
-	sc.ChangeGroupMembers(group, sendMsgChan)
+	err = sc.ChangeGroupMembers(group, sendMsgChan)
 	if err != nil {
 		return groupID, err
 	}
 
-	sc.RenameGroup(group, sendMsgChan)
+	err = sc.RenameGroup(group, sendMsgChan)
 	if err != nil {
 		return groupID, err
 	}
 
-	return groupID, nil
+	sc.ID.Groups.Add(group)
+
+	return group.GroupID, nil
 }
 
 // RenameGroup Sends a message with the new group name to all members
 func (sc *SessionContext) RenameGroup(group Group, sendMsgChan chan<- Message) (err error) {
 
-	sgn := NewGroupManageSetNameMessages(sc, group)
+	sgn, err := NewGroupManageSetNameMessages(sc, group)
+	if err != nil {
+		return err
+	}
 	for _, msg := range sgn {
 		sendMsgChan <- msg
 	}
@@ -268,7 +346,10 @@ func (sc *SessionContext) RenameGroup(group Group, sendMsgChan chan<- Message) (
 // ChangeGroupMembers Sends a message with the new group member list to all members
 func (sc *SessionContext) ChangeGroupMembers(group Group, sendMsgChan chan<- Message) (err error) {
 
-	sgm := NewGroupManageSetMembersMessages(sc, group)
+	sgm, err := NewGroupManageSetMembersMessages(sc, group)
+	if err != nil {
+		return err
+	}
 	for _, msg := range sgm {
 		sendMsgChan <- msg
 	}
@@ -279,7 +360,10 @@ func (sc *SessionContext) ChangeGroupMembers(group Group, sendMsgChan chan<- Mes
 // LeaveGroup Sends a message to all members telling them the sender left the group
 func (sc *SessionContext) LeaveGroup(group Group, sendMsgChan chan<- Message) (err error) {
 
-	sgm := NewGroupMemberLeftMessages(sc, group)
+	sgm, err := NewGroupMemberLeftMessages(sc, group)
+	if err != nil {
+		return err
+	}
 	for _, msg := range sgm {
 		sendMsgChan <- msg
 	}
@@ -0,0 +1,205 @@
+package o3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FeatureMask is a bit field of the features a client supports. Text, image and video messages
+// are supported by every client and have no bit.
+type FeatureMask uint64
+
+// FeatureMask mock enum
+const (
+	FEATUREAUDIO  FeatureMask = 0x01 //indicates support for audio messages
+	FEATUREGROUPS FeatureMask = 0x02 //indicates support for group chats
+	FEATUREPOLLS  FeatureMask = 0x04 //indicates support for polls (ballots)
+	FEATUREFILES  FeatureMask = 0x08 //indicates support for file messages
+	FEATUREVOIP   FeatureMask = 0x10 //indicates support for VoIP calls
+)
+
+// DefaultFeatureMask announces the features implemented by o3
+const DefaultFeatureMask = FEATUREAUDIO | FEATUREGROUPS
+
+// featureMaskMaxAge is how long a fetched feature mask lacking a feature is believed before it is
+// fetched again, as clients gain features with updates
+const featureMaskMaxAge = 24 * time.Hour
+
+var featureNames = []struct {
+	feature FeatureMask
+	name    string
+}{
+	{FEATUREAUDIO, "audio"},
+	{FEATUREGROUPS, "groups"},
+	{FEATUREPOLLS, "polls"},
+	{FEATUREFILES, "files"},
+	{FEATUREVOIP, "voip"},
+}
+
+// Has reports whether all features in f are set in fm
+func (fm FeatureMask) Has(f FeatureMask) bool {
+	return fm&f == f
+}
+
+func (fm FeatureMask) String() string {
+	var names []string
+	for _, fn := range featureNames {
+		if fm.Has(fn.feature) {
+			names = append(names, fn.name)
+			fm &^= fn.feature
+		}
+	}
+	if fm != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint64(fm)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// UnsupportedFeature is returned when a message cannot be sent because the recipient's client does
+// not support it
+type UnsupportedFeature struct {
+	ID      IDString
+	Feature FeatureMask
+}
+
+func (uf UnsupportedFeature) Error() string {
+	return fmt.Sprintf("%s does not support %s", uf.ID, uf.Feature)
+}
+
+// SetFeatureMask announces the features supported by the client of thid to the directory server
+func (tr ThreemaRest) SetFeatureMask(thid ThreemaID, mask FeatureMask) error {
+	request := struct {
+		Identity    string      `json:"identity"`
+		FeatureMask FeatureMask `json:"featureMask"`
+	}{thid.String(), mask}
+
+	return tr.signedRequest("identity/set_featuremask", request, &thid.LSK, nil)
+}
+
+// FeatureMasks fetches the feature masks of the given IDs. IDs unknown to the server are missing
+// from the result.
+func (tr ThreemaRest) FeatureMasks(ids []IDString) (map[IDString]FeatureMask, error) {
+	request := struct {
+		Identities []string `json:"identities"`
+	}{make([]string, len(ids))}
+	for i, id := range ids {
+		request.Identities[i] = id.String()
+	}
+
+	var response struct {
+		FeatureMasks []*FeatureMask `json:"featureMasks"`
+	}
+	if err := tr.postJSON("identity/check_featuremask", request, &response); err != nil {
+		return nil, err
+	}
+	if len(response.FeatureMasks) != len(ids) {
+		return nil, fmt.Errorf("server returned %d feature masks for %d IDs", len(response.FeatureMasks), len(ids))
+	}
+
+	masks := make(map[IDString]FeatureMask, len(ids))
+	for i, fm := range response.FeatureMasks {
+		if fm != nil {
+			masks[ids[i]] = *fm
+		}
+	}
+	return masks, nil
+}
+
+// SetFeatureMask announces the features supported by this client
+func (sc *SessionContext) SetFeatureMask(mask FeatureMask) error {
+	return sc.Rest.SetFeatureMask(sc.ID, mask)
+}
+
+// FetchFeatureMasks fetches the feature masks of the given IDs in one request and stores them in
+// the AddressBook for contacts already known. Known contacts missing from the result are stored
+// with an empty mask.
+func (sc *SessionContext) FetchFeatureMasks(ids ...string) (map[IDString]FeatureMask, error) {
+	parsed := make([]IDString, len(ids))
+	for i, id := range ids {
+		var err error
+		if parsed[i], err = ParseIDString(id); err != nil {
+			return nil, err
+		}
+	}
+
+	masks, err := sc.Rest.FeatureMasks(parsed)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range parsed {
+		sc.ID.Contacts.SetFeatureMask(id.String(), masks[id])
+	}
+	return masks, nil
+}
+
+// staleFeatureMask reports whether the cached feature mask of contact lacks f and is old enough to
+// be fetched again
+func staleFeatureMask(contact ThreemaContact, f FeatureMask) bool {
+	return !contact.FeatureMask.Has(f) && time.Since(contact.FeatureMaskFetched) >= featureMaskMaxAge
+}
+
+// refreshFeatureMasks fetches the stale feature masks of the given IDs lacking f in one request,
+// so supports does not ask for them one by one
+func (sc *SessionContext) refreshFeatureMasks(ids []IDString, f FeatureMask) error {
+	var stale []string
+	for _, id := range ids {
+		if id == sc.ID.ID {
+			continue
+		}
+		contact, err := sc.lookupContact(id)
+		if err != nil {
+			return err
+		}
+		if staleFeatureMask(contact, f) {
+			stale = append(stale, id.String())
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	_, err := sc.FetchFeatureMasks(stale...)
+	return err
+}
+
+// supportsGroups returns UnsupportedFeature for the first member of group whose client does not
+// support groups
+func (sc *SessionContext) supportsGroups(group Group) error {
+	if err := sc.refreshFeatureMasks(group.Members, FEATUREGROUPS); err != nil {
+		return err
+	}
+	for _, id := range group.Members {
+		ok, err := sc.supports(id, FEATUREGROUPS)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return UnsupportedFeature{ID: id, Feature: FEATUREGROUPS}
+		}
+	}
+	return nil
+}
+
+// supports reports whether the client of the given ID supports the feature f. The cached feature
+// mask is refreshed from the server if it lacks f and is stale.
+func (sc *SessionContext) supports(id IDString, f FeatureMask) (bool, error) {
+	if id == sc.ID.ID {
+		return true, nil
+	}
+	contact, err := sc.lookupContact(id)
+	if err != nil {
+		return false, err
+	}
+	if !staleFeatureMask(contact, f) {
+		return contact.FeatureMask.Has(f), nil
+	}
+
+	masks, err := sc.FetchFeatureMasks(id.String())
+	if err != nil {
+		return false, err
+	}
+	return masks[id].Has(f), nil
+}
@@ -0,0 +1,334 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DefaultGatewayURL is the base URL of the Threema Gateway HTTP API
+const DefaultGatewayURL = "https://msgapi.threema.ch"
+
+// GatewayClient uses the HTTP API of the Threema Gateway to send messages from a gateway ID,
+// i.e. an ID starting with '*'. Gateway IDs cannot log in to the chat server. In basic mode the
+// server encrypts messages on behalf of the gateway ID, in end-to-end mode the messages are
+// encrypted locally with the ID's private key.
+type GatewayClient struct {
+	// ID is the gateway ID. Its LSK is required for end-to-end mode, public keys of
+	// recipients are pinned in its Contacts.
+	ID     ThreemaID
+	Secret string
+	// BaseURL is the base URL of the gateway API, DefaultGatewayURL unless changed
+	BaseURL string
+	// Client is used for all requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewGatewayClient returns a GatewayClient for the gateway ID id authenticating with secret.
+// Use the zero private key for basic mode.
+func NewGatewayClient(id string, secret string, lsk [32]byte) (*GatewayClient, error) {
+	gwid, err := ParseIDString(id)
+	if err != nil {
+		return nil, err
+	}
+	if !gwid.IsGateway() {
+		return nil, fmt.Errorf("%s is not a gateway ID", id)
+	}
+	return &GatewayClient{
+		ID: ThreemaID{
+			ID:       gwid,
+			LSK:      lsk,
+			Contacts: NewAddressBook(),
+			Groups:   NewGroupBook()},
+		Secret:  secret,
+		BaseURL: DefaultGatewayURL}, nil
+}
+
+// GatewayError is returned if the gateway responds with an error status
+type GatewayError struct {
+	StatusCode int
+	Status     string
+}
+
+func (ge GatewayError) Error() string {
+	var reason string
+	switch ge.StatusCode {
+	case http.StatusBadRequest:
+		reason = "invalid recipient or parameters"
+	case http.StatusUnauthorized:
+		reason = "wrong ID or secret"
+	case http.StatusPaymentRequired:
+		reason = "no credits remaining"
+	case http.StatusNotFound:
+		reason = "not found"
+	case http.StatusRequestEntityTooLarge:
+		reason = "message or blob too long"
+	default:
+		reason = "request failed"
+	}
+	return fmt.Sprintf("gateway: %s (%s)", reason, ge.Status)
+}
+
+// auth returns the authentication parameters of the gateway ID
+func (gc *GatewayClient) auth() url.Values {
+	return url.Values{
+		"from":   {gc.ID.String()},
+		"secret": {gc.Secret}}
+}
+
+// do sends the request and returns the body of a successful response
+func (gc *GatewayClient) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("Accept", "*/*")
+	client := gc.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, GatewayError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// get requests path with the authentication parameters and returns the trimmed response body
+func (gc *GatewayClient) get(path string) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(gc.BaseURL, "/")+path+"?"+gc.auth().Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := gc.do(req)
+	return strings.TrimSpace(string(body)), err
+}
+
+// post sends the form including the authentication parameters to path and returns the trimmed
+// response body
+func (gc *GatewayClient) post(path string, form url.Values) (string, error) {
+	for k, v := range gc.auth() {
+		form[k] = v
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(gc.BaseURL, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := gc.do(req)
+	return strings.TrimSpace(string(body)), err
+}
+
+// SendSimple sends text to the recipient ID in basic mode and returns the message ID assigned by
+// the gateway
+func (gc *GatewayClient) SendSimple(recipient string, text string) (string, error) {
+	to, err := ParseIDString(recipient)
+	if err != nil {
+		return "", err
+	}
+	return gc.post("/send_simple", url.Values{
+		"to":   {to.String()},
+		"text": {text}})
+}
+
+// PubKey returns the public key of the given ID. Keys are pinned in the gateway ID's Contacts on
+// first use. A KeyChange error is returned if the gateway reports a different key later on.
+func (gc *GatewayClient) PubKey(id string) ([32]byte, error) {
+	tid, err := ParseIDString(id)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if _, ok := gc.ID.Contacts.KeyChanged(tid.String()); !ok {
+		if c, ok := gc.ID.Contacts.Get(tid.String()); ok {
+			return c.LPK, nil
+		}
+	}
+
+	body, err := gc.get("/pubkeys/" + tid.String())
+	if err != nil {
+		return [32]byte{}, err
+	}
+	contact := ThreemaContact{ID: tid, Level: SERVERFETCHED}
+	if err := decodeKey(body, &contact.LPK); err != nil {
+		return [32]byte{}, err
+	}
+	pinned, err := gc.ID.Contacts.Pin(contact)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return pinned.LPK, nil
+}
+
+// Capabilities returns the capabilities of the given ID, e.g. "text", "image" or "file"
+func (gc *GatewayClient) Capabilities(id string) ([]string, error) {
+	tid, err := ParseIDString(id)
+	if err != nil {
+		return nil, err
+	}
+	body, err := gc.get("/capabilities/" + tid.String())
+	if err != nil {
+		return nil, err
+	}
+	var caps []string
+	for _, c := range strings.Split(body, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// Credits returns the number of remaining message credits of the gateway ID
+func (gc *GatewayClient) Credits() (int, error) {
+	body, err := gc.get("/credits")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(body)
+}
+
+// LookupByPhone returns the ID linked to the phone number given in E.164 format without '+'
+func (gc *GatewayClient) LookupByPhone(phone string) (IDString, error) {
+	return gc.lookup("/lookup/phone/" + url.PathEscape(phone))
+}
+
+// LookupByEmail returns the ID linked to the email address
+func (gc *GatewayClient) LookupByEmail(email string) (IDString, error) {
+	return gc.lookup("/lookup/email/" + url.PathEscape(email))
+}
+
+func (gc *GatewayClient) lookup(path string) (IDString, error) {
+	body, err := gc.get(path)
+	if err != nil {
+		return IDString{}, err
+	}
+	return ParseIDString(body)
+}
+
+// UploadBlob uploads an already encrypted blob and returns the assigned blob ID
+func (gc *GatewayClient) UploadBlob(blob []byte) ([16]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("blob", "blob.bin")
+	if err != nil {
+		return [16]byte{}, err
+	}
+	if _, err := io.Copy(part, bytes.NewReader(blob)); err != nil {
+		return [16]byte{}, err
+	}
+	if err := mw.Close(); err != nil {
+		return [16]byte{}, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(gc.BaseURL, "/")+"/upload_blob?"+gc.auth().Encode(), &buf)
+	if err != nil {
+		return [16]byte{}, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	body, err := gc.do(req)
+	if err != nil {
+		return [16]byte{}, err
+	}
+
+	blobIDbytes, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return [16]byte{}, err
+	}
+	if len(blobIDbytes) != 16 {
+		return [16]byte{}, fmt.Errorf("gateway returned invalid blob ID length: %d", len(blobIDbytes))
+	}
+	var blobID [16]byte
+	copy(blobID[:], blobIDbytes)
+	return blobID, nil
+}
+
+// SendMessage encrypts m for its recipient and sends it in end-to-end mode. It returns the message
+// ID assigned by the gateway.
+func (gc *GatewayClient) SendMessage(m Message) (string, error) {
+	if err := gc.checkE2E(); err != nil {
+		return "", err
+	}
+	mh := m.header()
+	pk, err := gc.PubKey(mh.recipient.String())
+	if err != nil {
+		return "", err
+	}
+
+	n := newRandomNonce()
+	ciphertext := box.Seal(nil, m.Serialize(), n.bytes(), &pk, &gc.ID.LSK)
+	return gc.post("/send_e2e", url.Values{
+		"to":    {mh.recipient.String()},
+		"nonce": {hex.EncodeToString(n.byteSlice())},
+		"box":   {hex.EncodeToString(ciphertext)}})
+}
+
+// checkE2E returns an error if the client lacks the private key required for end-to-end mode
+func (gc *GatewayClient) checkE2E() error {
+	if gc.ID.LSK == ([32]byte{}) {
+		return errors.New("gateway: end-to-end mode requires the private key of the gateway ID")
+	}
+	return nil
+}
+
+// header returns the header of a new message from the gateway ID to recipient
+func (gc *GatewayClient) header(recipient string) (messageHeader, error) {
+	to, err := ParseIDString(recipient)
+	if err != nil {
+		return messageHeader{}, err
+	}
+	return messageHeader{
+		sender:    gc.ID.ID,
+		recipient: to,
+		id:        NewMsgID(),
+		time:      time.Now(),
+		pubNick:   gc.ID.Nick}, nil
+}
+
+// SendTextMessage sends text to the recipient in end-to-end mode
+func (gc *GatewayClient) SendTextMessage(recipient string, text string) (string, error) {
+	mh, err := gc.header(recipient)
+	if err != nil {
+		return "", err
+	}
+	return gc.SendMessage(TextMessage{mh, textMessageBody{text: text}})
+}
+
+// SendImageMessage encrypts and uploads the image data and sends it to the recipient in
+// end-to-end mode
+func (gc *GatewayClient) SendImageMessage(recipient string, image []byte) (string, error) {
+	if err := gc.checkE2E(); err != nil {
+		return "", err
+	}
+	mh, err := gc.header(recipient)
+	if err != nil {
+		return "", err
+	}
+	pk, err := gc.PubKey(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	blobNonce := newRandomNonce()
+	ciphertext := box.Seal(nil, image, blobNonce.bytes(), &pk, &gc.ID.LSK)
+	blobID, err := gc.UploadBlob(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return gc.SendMessage(ImageMessage{mh, imageMessageBody{
+		BlobID:   blobID,
+		ServerID: blobID[0],
+		Size:     uint32(len(ciphertext)),
+		Nonce:    blobNonce}})
+}
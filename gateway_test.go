@@ -0,0 +1,230 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeGateway implements the parts of the gateway API used by GatewayClient for a single
+// recipient ECHOECHO
+type fakeGateway struct {
+	gwPK     [32]byte
+	peerPK   [32]byte
+	peerSK   [32]byte
+	mu       sync.Mutex
+	received []*bytes.Buffer
+	blobs    map[string][]byte
+}
+
+func (fg *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	if r.FormValue("from") != "*TESTGW1" || r.FormValue("secret") != "s3cret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/send_simple":
+		if r.FormValue("to") != "ECHOECHO" || r.FormValue("text") != "basic" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("0123456789abcdef"))
+	case "/send_e2e":
+		nonceBytes, _ := hex.DecodeString(r.FormValue("nonce"))
+		ciphertext, _ := hex.DecodeString(r.FormValue("box"))
+		var n nonce
+		n.set(nonceBytes)
+		plain, ok := box.Open(nil, ciphertext, n.bytes(), &fg.gwPK, &fg.peerSK)
+		if !ok || r.FormValue("to") != "ECHOECHO" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fg.received = append(fg.received, bytes.NewBuffer(plain))
+		w.Write([]byte("fedcba9876543210\n"))
+	case "/pubkeys/ECHOECHO":
+		w.Write([]byte(hex.EncodeToString(fg.peerPK[:])))
+	case "/capabilities/ECHOECHO":
+		w.Write([]byte("text,image,file"))
+	case "/credits":
+		w.Write([]byte("100\n"))
+	case "/lookup/phone/41791234567":
+		w.Write([]byte("ECHOECHO"))
+	case "/upload_blob":
+		f, _, err := r.FormFile("blob")
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		id := "00112233445566778899aabbccddeeff"
+		fg.blobs[id] = data
+		w.Write([]byte(id))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGatewayClient(t *testing.T) {
+	gwPK, gwSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fg := &fakeGateway{gwPK: *gwPK, peerPK: *peerPK, peerSK: *peerSK, blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	if _, err := NewGatewayClient("ECHOECHO", "s3cret", *gwSK); err == nil {
+		t.Error("gateway client for a regular ID created")
+	}
+	gc, err := NewGatewayClient("*TESTGW1", "s3cret", *gwSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.BaseURL = srv.URL
+
+	if id, err := gc.SendSimple("ECHOECHO", "basic"); err != nil || id != "0123456789abcdef" {
+		t.Errorf("send_simple: %q, %v", id, err)
+	}
+	if _, err := gc.SendSimple("echoecho", "basic"); err == nil {
+		t.Error("message to invalid ID sent")
+	}
+
+	if id, err := gc.SendTextMessage("ECHOECHO", "end-to-end"); err != nil || id != "fedcba9876543210" {
+		t.Fatalf("send_e2e: %q, %v", id, err)
+	}
+	if c, ok := gc.ID.Contacts.Get("ECHOECHO"); !ok || c.LPK != *peerPK || c.Level != SERVERFETCHED {
+		t.Errorf("public key not pinned: %#v", c)
+	}
+
+	image := []byte("not really a JPEG")
+	if _, err := gc.SendImageMessage("ECHOECHO", image); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fg.received) != 2 {
+		t.Fatalf("gateway received %d messages", len(fg.received))
+	}
+	if mt := parseMessageType(fg.received[0]); mt != TEXTMESSAGE {
+		t.Errorf("first message has type %v", mt)
+	}
+	if tm := parseTextMessage(fg.received[0]); tm.text != "end-to-end" {
+		t.Errorf("received text %q", tm.text)
+	}
+	if mt := parseMessageType(fg.received[1]); mt != IMAGEMESSAGE {
+		t.Errorf("second message has type %v", mt)
+	}
+	im := parseImageMessage(fg.received[1])
+	blob := fg.blobs[hex.EncodeToString(im.BlobID[:])]
+	if plain, ok := box.Open(nil, blob, im.Nonce.bytes(), gwPK, peerSK); !ok || !bytes.Equal(plain, image) {
+		t.Error("image could not be decrypted by the recipient")
+	}
+
+	if caps, err := gc.Capabilities("ECHOECHO"); err != nil || !reflect.DeepEqual(caps, []string{"text", "image", "file"}) {
+		t.Errorf("capabilities: %v, %v", caps, err)
+	}
+	if credits, err := gc.Credits(); err != nil || credits != 100 {
+		t.Errorf("credits: %d, %v", credits, err)
+	}
+	if id, err := gc.LookupByPhone("41791234567"); err != nil || id != NewIDString("ECHOECHO") {
+		t.Errorf("lookup: %s, %v", id, err)
+	}
+	if _, err := gc.LookupByEmail("nobody@example.com"); err == nil {
+		t.Error("lookup of unknown email succeeded")
+	} else if ge, ok := err.(GatewayError); !ok || ge.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected lookup error: %v", err)
+	}
+
+	gc.Secret = "wrong"
+	if _, err := gc.Credits(); err == nil {
+		t.Error("wrong secret accepted")
+	}
+}
+
+func TestGatewayReceiver(t *testing.T) {
+	gwPK, gwSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fg := &fakeGateway{gwPK: *gwPK, peerPK: *peerPK, peerSK: *peerSK, blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fg)
+	defer srv.Close()
+
+	gc, err := NewGatewayClient("*TESTGW1", "s3cret", *gwSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.BaseURL = srv.URL
+	gr := NewGatewayReceiver(gc)
+
+	callback := func(text string, secret string) *httptest.ResponseRecorder {
+		tm := TextMessage{textMessageBody: textMessageBody{text: text}}
+		n := newRandomNonce()
+		form := url.Values{
+			"from":      {"ECHOECHO"},
+			"to":        {"*TESTGW1"},
+			"messageId": {"0102030405060708"},
+			"date":      {"1500000000"},
+			"nonce":     {hex.EncodeToString(n.byteSlice())},
+			"box":       {hex.EncodeToString(box.Seal(nil, tm.Serialize(), n.bytes(), gwPK, peerSK))},
+			"nickname":  {"Echo"}}
+		mac := callbackMAC(secret, form.Get("from"), form.Get("to"), form.Get("messageId"), form.Get("date"), form.Get("nonce"), form.Get("box"))
+		form.Set("mac", hex.EncodeToString(mac))
+
+		req := httptest.NewRequest("POST", "/callback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		gr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := callback("forged", "wrong secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("forged callback answered with %d", rec.Code)
+	}
+
+	if rec := callback("hello gateway", "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("callback answered with %d: %s", rec.Code, rec.Body)
+	}
+	select {
+	case rmsg := <-gr.Messages():
+		if rmsg.Err != nil {
+			t.Fatal(rmsg.Err)
+		}
+		tm, ok := rmsg.Msg.(TextMessage)
+		if !ok || tm.Text() != "hello gateway" || tm.Sender() != NewIDString("ECHOECHO") || tm.ID() != 0x0807060504030201 {
+			t.Errorf("unexpected message %#v", rmsg.Msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+
+	var got []Message
+	gr.OnMessage = func(m Message) { got = append(got, m) }
+	if rec := callback("via callback", "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("callback answered with %d: %s", rec.Code, rec.Body)
+	}
+	if len(got) != 1 || got[0].(TextMessage).Text() != "via callback" {
+		t.Errorf("OnMessage received %#v", got)
+	}
+}
@@ -0,0 +1,156 @@
+package o3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// GatewayReceiver is an http.Handler for the callback the Threema Gateway uses to deliver
+// incoming messages of a gateway ID. Requests are authenticated by their MAC, decrypted with the
+// private key of the gateway ID and decoded like messages received by a SessionContext.
+type GatewayReceiver struct {
+	gc *GatewayClient
+	// OnMessage is called with every received message if set. Otherwise messages are delivered
+	// through the channel returned by Messages.
+	OnMessage      func(Message)
+	receiveMsgChan *dynRecvChan
+}
+
+// NewGatewayReceiver returns a GatewayReceiver for the gateway ID of gc. The secret of gc is used to
+// verify callbacks and gc is used to look up the public keys of senders.
+func NewGatewayReceiver(gc *GatewayClient) *GatewayReceiver {
+	return &GatewayReceiver{
+		gc:             gc,
+		receiveMsgChan: newDynRecvChan()}
+}
+
+// Messages returns the channel received messages are delivered on unless OnMessage is set. Messages
+// that cannot be decrypted or decoded are delivered with Err set.
+func (gr *GatewayReceiver) Messages() <-chan ReceivedMsg {
+	return gr.receiveMsgChan.Out
+}
+
+// callbackMAC computes the MAC the gateway sends along with a callback
+func callbackMAC(secret string, from, to, messageID, date, nonce, box string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{from, to, messageID, date, nonce, box} {
+		mac.Write([]byte(field))
+	}
+	return mac.Sum(nil)
+}
+
+func (gr *GatewayReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, to := r.PostFormValue("from"), r.PostFormValue("to")
+	messageID, date := r.PostFormValue("messageId"), r.PostFormValue("date")
+	nonceHex, boxHex := r.PostFormValue("nonce"), r.PostFormValue("box")
+
+	mac, err := hex.DecodeString(r.PostFormValue("mac"))
+	if err != nil || !hmac.Equal(mac, callbackMAC(gr.gc.Secret, from, to, messageID, date, nonceHex, boxHex)) {
+		http.Error(w, "invalid MAC", http.StatusUnauthorized)
+		return
+	}
+
+	mp, err := gr.messagePacket(from, to, messageID, date, nonceHex, boxHex, r.PostFormValue("nickname"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rmsg ReceivedMsg
+	mp.Plaintext, err = gr.open(mp)
+	if err == nil {
+		rmsg.Msg, rmsg.Err = decodeMessage(mp)
+	} else {
+		rmsg.Err = err
+	}
+
+	if gr.OnMessage != nil {
+		if rmsg.Err != nil {
+			http.Error(w, rmsg.Err.Error(), http.StatusBadRequest)
+			return
+		}
+		gr.OnMessage(rmsg.Msg)
+	} else {
+		gr.receiveMsgChan.In <- rmsg
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// messagePacket decodes the fields of a callback into a messagePacket
+func (gr *GatewayReceiver) messagePacket(from, to, messageID, date, nonceHex, boxHex, nickname string) (messagePacket, error) {
+	var mp messagePacket
+
+	sender, err := ParseIDString(from)
+	if err != nil {
+		return mp, err
+	}
+	recipient, err := ParseIDString(to)
+	if err != nil {
+		return mp, err
+	}
+	if recipient != gr.gc.ID.ID {
+		return mp, fmt.Errorf("message addressed to %s", to)
+	}
+
+	id, err := hex.DecodeString(messageID)
+	if err != nil || len(id) != 8 {
+		return mp, errors.New("invalid message ID")
+	}
+	unix, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return mp, errors.New("invalid date")
+	}
+	nonceBytes, err := hex.DecodeString(nonceHex)
+	if err != nil || len(nonceBytes) != 24 {
+		return mp, errors.New("invalid nonce")
+	}
+	ciphertext, err := hex.DecodeString(boxHex)
+	if err != nil {
+		return mp, errors.New("invalid box")
+	}
+
+	mp = messagePacket{
+		PktType:    deliveringMsg,
+		Sender:     sender,
+		Recipient:  recipient,
+		ID:         binary.LittleEndian.Uint64(id),
+		Time:       time.Unix(unix, 0),
+		PubNick:    NewPubNick(nickname),
+		Ciphertext: ciphertext}
+	mp.Nonce.set(nonceBytes)
+	return mp, nil
+}
+
+// open decrypts the message using the sender's public key
+func (gr *GatewayReceiver) open(mp messagePacket) ([]byte, error) {
+	if err := gr.gc.checkE2E(); err != nil {
+		return nil, err
+	}
+	pk, err := gr.gc.PubKey(mp.Sender.String())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := box.Open(nil, mp.Ciphertext, mp.Nonce.bytes(), &pk, &gr.gc.ID.LSK)
+	if !ok {
+		return nil, fmt.Errorf("cannot decrypt message %x from %s", mp.ID, mp.Sender)
+	}
+	return plaintext, nil
+}
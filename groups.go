@@ -1,5 +1,13 @@
 package o3
 
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
 // Group represents a Threema chat group
 type Group struct {
 	CreatorID IDString
@@ -7,3 +15,184 @@ type Group struct {
 	Name      string
 	Members   []IDString
 }
+
+// Validate checks the IDs of the group's creator and members, see ParseIDString
+func (g Group) Validate() error {
+	if err := g.CreatorID.Validate(); err != nil {
+		return fmt.Errorf("group creator: %v", err)
+	}
+	for _, m := range g.Members {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("group member: %v", err)
+		}
+	}
+	return nil
+}
+
+// GroupBook is the register of known Groups, indexed by creator and group ID. Like the AddressBook
+// it is safe for concurrent use and copies share their content. Create one with NewGroupBook, a
+// zero value can only be filled by UnmarshalJSON and other methods panic on it.
+type GroupBook struct {
+	mu     *sync.RWMutex
+	groups map[IDString]map[[8]byte]Group // groups[GroupCreator][GroupID]
+}
+
+// NewGroupBook returns an empty GroupBook
+func NewGroupBook() GroupBook {
+	return GroupBook{
+		mu:     new(sync.RWMutex),
+		groups: make(map[IDString]map[[8]byte]Group)}
+}
+
+// lock returns the mutex of the GroupBook
+func (gb *GroupBook) lock() *sync.RWMutex {
+	if gb.mu == nil {
+		panic("o3: GroupBook used without NewGroupBook")
+	}
+	return gb.mu
+}
+
+// initialize turns a zero value into an empty GroupBook, see AddressBook.initialize
+func (gb *GroupBook) initialize() {
+	if gb.mu == nil {
+		*gb = NewGroupBook()
+	}
+}
+
+// copyGroup returns g with its own copy of the member list
+func copyGroup(g Group) Group {
+	g.Members = append([]IDString(nil), g.Members...)
+	return g
+}
+
+// Add stores the group, replacing any group with the same creator and ID
+func (gb *GroupBook) Add(g Group) {
+	mu := gb.lock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	byCreator, ok := gb.groups[g.CreatorID]
+	if !ok {
+		byCreator = make(map[[8]byte]Group)
+		gb.groups[g.CreatorID] = byCreator
+	}
+	byCreator[g.GroupID] = copyGroup(g)
+}
+
+// Get returns the group with the given creator and ID. The second return value reports whether
+// the group was found.
+func (gb *GroupBook) Get(creator IDString, groupID [8]byte) (Group, bool) {
+	mu := gb.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	g, ok := gb.groups[creator][groupID]
+	if !ok {
+		return Group{}, false
+	}
+	return copyGroup(g), true
+}
+
+// Remove deletes the group with the given creator and ID
+func (gb *GroupBook) Remove(creator IDString, groupID [8]byte) {
+	mu := gb.lock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(gb.groups[creator], groupID)
+	if len(gb.groups[creator]) == 0 {
+		delete(gb.groups, creator)
+	}
+}
+
+// List returns copies of all known groups
+func (gb *GroupBook) List() []Group {
+	mu := gb.lock()
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var groups []Group
+	for _, byCreator := range gb.groups {
+		for _, g := range byCreator {
+			groups = append(groups, copyGroup(g))
+		}
+	}
+	return groups
+}
+
+type groupRecord struct {
+	Creator string   `json:"creator"`
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Members []string `json:"members"`
+}
+
+// MarshalJSON encodes the GroupBook as a list of groups
+func (gb *GroupBook) MarshalJSON() ([]byte, error) {
+	groups := gb.List()
+	records := make([]groupRecord, len(groups))
+	for i, g := range groups {
+		records[i] = groupRecord{
+			Creator: g.CreatorID.String(),
+			ID:      hex.EncodeToString(g.GroupID[:]),
+			Name:    g.Name,
+			Members: make([]string, len(g.Members))}
+		for j, m := range g.Members {
+			records[i].Members[j] = m.String()
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Creator != records[j].Creator {
+			return records[i].Creator < records[j].Creator
+		}
+		return records[i].ID < records[j].ID
+	})
+	return json.Marshal(records)
+}
+
+// UnmarshalJSON replaces the content of the GroupBook with the encoded groups
+func (gb *GroupBook) UnmarshalJSON(data []byte) error {
+	var records []groupRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	groups := NewGroupBook()
+	for _, r := range records {
+		creator, err := ParseIDString(r.Creator)
+		if err != nil {
+			return err
+		}
+		g := Group{
+			CreatorID: creator,
+			Name:      r.Name,
+			Members:   make([]IDString, len(r.Members))}
+		id, err := hex.DecodeString(r.ID)
+		if err != nil {
+			return err
+		}
+		if len(id) != 8 {
+			return fmt.Errorf("group of %s: invalid group ID length: %d", r.Creator, len(id))
+		}
+		copy(g.GroupID[:], id)
+		for i, m := range r.Members {
+			if g.Members[i], err = ParseIDString(m); err != nil {
+				return fmt.Errorf("group of %s: %s", r.Creator, err)
+			}
+		}
+		groups.Add(g)
+	}
+
+	gb.initialize()
+	mu := gb.lock()
+	mu.Lock()
+	defer mu.Unlock()
+	// refill the map in place, so copies sharing it see the new content
+	for creator := range gb.groups {
+		delete(gb.groups, creator)
+	}
+	for creator, byCreator := range groups.groups {
+		gb.groups[creator] = byCreator
+	}
+	return nil
+}
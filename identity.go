@@ -7,6 +7,7 @@ import (
 	"encoding/base32"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -47,14 +48,46 @@ func NewIDString(ids string) IDString {
 	return buf
 }
 
+// ParseIDString creates an IDString from the input string after verifying that it is a valid
+// Threema ID: exactly 8 characters out of A-Z and 0-9. Gateway IDs start with '*' instead.
+func ParseIDString(ids string) (IDString, error) {
+	if len(ids) != 8 {
+		return IDString{}, fmt.Errorf("invalid Threema ID %q: length must be exactly 8", ids)
+	}
+	for i, c := range []byte(ids) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || (c == '*' && i == 0) {
+			continue
+		}
+		return IDString{}, fmt.Errorf("invalid Threema ID %q: illegal character %q", ids, c)
+	}
+	return NewIDString(ids), nil
+}
+
+// NormalizeIDString parses an ID entered by a user. Surrounding whitespace is removed and
+// lowercase letters are converted to uppercase before the ID is verified by ParseIDString.
+func NormalizeIDString(ids string) (IDString, error) {
+	return ParseIDString(strings.ToUpper(strings.TrimSpace(ids)))
+}
+
+// Validate checks that the IDString is a valid Threema ID, see ParseIDString
+func (is IDString) Validate() error {
+	_, err := ParseIDString(is.String())
+	return err
+}
+
+// IsGateway reports whether the IDString belongs to a Threema Gateway ID
+func (is IDString) IsGateway() bool {
+	return is[0] == '*'
+}
+
 // ThreemaID is the core ID type. It contains the 8-byte ID, its corresponding 32-byte 256-bit private key,
-// and a list of known Contacts.
+// and the known Contacts and Groups.
 type ThreemaID struct {
 	ID       IDString
 	Nick     PubNick
 	LSK      [32]byte
 	Contacts AddressBook
-	Groups   map[IDString]map[[8]byte]Group // Groups[GroupCreator][GroupID]
+	Groups   GroupBook
 }
 
 // GetPubKey generates the PK on the fly, that's ok because it's rarely needed
@@ -136,7 +169,8 @@ func encryptID(id, pk, password []byte) (string, error) {
 }
 
 // LoadIDFromFile will open a Threema identity backup file and parse its base32-encoded encrypted ID using
-// the provided password into a ThreemaID
+// the provided password into a ThreemaID. Whitespace around the backup string, e.g. a trailing newline,
+// is ignored.
 func LoadIDFromFile(filename string, password []byte) (ThreemaID, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -144,21 +178,42 @@ func LoadIDFromFile(filename string, password []byte) (ThreemaID, error) {
 	}
 	defer file.Close()
 
-	buf := make([]byte, 100)
-
-	n, err := file.Read(buf)
+	// a backup is 99 characters long, anything much larger is not a backup
+	buf, err := ioutil.ReadAll(io.LimitReader(file, 4096))
 	if err != nil {
 		return ThreemaID{}, err
-	} else if n != 100 {
-		return ThreemaID{}, errors.New("File does not contain a valid ID")
 	}
 
 	return ParseIDBackupString(string(buf), password)
 }
 
+// LoadIDFromFileWith works like LoadIDFromFile but obtains the password from the given PasswordProvider
+func LoadIDFromFileWith(filename string, pp PasswordProvider) (ThreemaID, error) {
+	password, err := pp.Password()
+	if err != nil {
+		return ThreemaID{}, err
+	}
+	if len(password) == 0 {
+		return ThreemaID{}, errEmptyPassword
+	}
+	return LoadIDFromFile(filename, password)
+}
+
+// idBackupLength is the number of base32 characters in a backup string without dashes
+const idBackupLength = 80
+
 // ParseIDBackupString parses the base32-encoded encrypted ID string contained in a threema backup.
+// Surrounding whitespace is ignored.
 func ParseIDBackupString(idstr string, password []byte) (ThreemaID, error) {
-	threemaID := ThreemaID{}
+	threemaID := ThreemaID{
+		Contacts: NewAddressBook(),
+		Groups:   NewGroupBook()}
+
+	idstr = strings.TrimSpace(idstr)
+	if len(strings.Replace(idstr, "-", "", -1)) != idBackupLength {
+		return threemaID, errors.New("File does not contain a valid ID")
+	}
+
 	id, lsk, err := decryptID(idstr, password)
 	if err != nil {
 		return threemaID, err
@@ -185,15 +240,18 @@ func (thid ThreemaID) SaveToFile(filename string, password []byte) error {
 func NewThreemaID(id string, lsk [32]byte, contacts AddressBook) (ThreemaID, error) {
 	var tid ThreemaID
 
-	if len(id) != 8 {
-		return tid, errors.New("Length of Threema ID must be exactly 8")
+	parsed, err := ParseIDString(id)
+	if err != nil {
+		return tid, err
 	}
-	copy(tid.ID[:], id[:])
+	tid.ID = parsed
 	tid.LSK = lsk
 
+	// initialize a zero value AddressBook before the ID and its copies share it
+	contacts.initialize()
 	tid.Contacts = contacts
 
-	tid.Groups = make(map[IDString]map[[8]byte]Group)
+	tid.Groups = NewGroupBook()
 
 	return tid, nil
 }
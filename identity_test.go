@@ -0,0 +1,135 @@
+package o3
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func alicePassword(t *testing.T) []byte {
+	pw, err := base64.StdEncoding.DecodeString("ThisIsAlice1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pw
+}
+
+func TestLoadIDFromFileWhitespace(t *testing.T) {
+	backup, err := ioutil.ReadFile("test/idAlice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadIDFromFile("test/idAlice", alicePassword(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trimmed := strings.TrimSpace(string(backup))
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bare":     trimmed,
+		"crlf":     trimmed + "\r\n",
+		"padded":   "  \n" + trimmed + " \n\n",
+		"tabbed":   "\t" + trimmed + "\t",
+		"multiple": trimmed + "\n" + trimmed + "\n",
+		"short":    trimmed[:90],
+	} {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := LoadIDFromFile(filename, alicePassword(t))
+		if name == "multiple" || name == "short" {
+			if err == nil {
+				t.Errorf("%s: invalid backup accepted", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.ID != want.ID || got.LSK != want.LSK {
+			t.Errorf("%s: loaded %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestPasswordProviders(t *testing.T) {
+	dir := t.TempDir()
+	password := alicePassword(t)
+
+	os.Setenv("O3_TEST_PASSWORD", string(password))
+	defer os.Unsetenv("O3_TEST_PASSWORD")
+
+	pwfile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(pwfile, append(password, '\r', '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	providers := map[string]PasswordProvider{
+		"env":      EnvPassword("O3_TEST_PASSWORD"),
+		"file":     FilePassword(pwfile),
+		"callback": PasswordFunc(func() ([]byte, error) { return password, nil }),
+	}
+	for name, pp := range providers {
+		tid, err := LoadIDFromFileWith("test/idAlice", pp)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if tid.String() != "7PBZRUSA" {
+			t.Errorf("%s: loaded wrong ID %s", name, tid)
+		}
+	}
+
+	if _, err := LoadIDFromFileWith("test/idAlice", EnvPassword("O3_TEST_UNSET_PASSWORD")); err == nil {
+		t.Error("unset environment variable accepted")
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(pwfile, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FilePassword(pwfile).Password(); err == nil {
+			t.Error("world-readable password file accepted")
+		}
+	}
+}
+
+func TestParseIDString(t *testing.T) {
+	for _, valid := range []string{"ECHOECHO", "7PBZRUSA", "*GATEWAY", "00000000"} {
+		if _, err := ParseIDString(valid); err != nil {
+			t.Errorf("%q rejected: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "ECHOECH", "ECHOECHOE", "echoecho", "ECHO ECH", "ECHOECH\n", "ECHO*ECH", "ECHOÉCH", "**GATEWA"} {
+		if _, err := ParseIDString(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+
+	id, err := NormalizeIDString(" echoEcho\n")
+	if err != nil || id != NewIDString("ECHOECHO") {
+		t.Errorf("normalized to %q, %v", id, err)
+	}
+	if !NewIDString("*GATEWAY").IsGateway() || NewIDString("ECHOECHO").IsGateway() {
+		t.Error("IsGateway misreported")
+	}
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("TESTSELF")})
+	if _, err := NewTextMessage(sc, "echoecho", "hi"); err == nil {
+		t.Error("text message to invalid recipient created")
+	}
+	group := Group{CreatorID: sc.ID.ID, Members: []IDString{NewIDString("ECHOECHO"), NewIDString("bad id")}}
+	if _, err := NewGroupTextMessages(sc, group, "hi"); err == nil {
+		t.Error("group text message to invalid member created")
+	}
+	if _, err := NewGroupManageSetMembersMessages(sc, group); err == nil {
+		t.Error("group members message to invalid member created")
+	}
+}
@@ -0,0 +1,298 @@
+package o3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"net/http"
+)
+
+// DefaultMaxImageDimension is the default limit of the width and height of processed images
+const DefaultMaxImageDimension = 1600
+
+// DefaultJPEGQuality is the default quality processed images are encoded with
+const DefaultJPEGQuality = 80
+
+// DefaultThumbnailDimension is the default limit of the width and height of thumbnails
+const DefaultThumbnailDimension = 512
+
+// maxImagePixels limits the size of images that are decoded, so a small file cannot make us
+// allocate gigabytes
+const maxImagePixels = 64 << 20
+
+// processableImageTypes are the MIME types of images ImageOptions can process
+var processableImageTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// ImageOptions controls how images are prepared before they are sent. Images are decoded,
+// downsized to fit the maximum dimensions and encoded as JPEG again, which also strips metadata
+// like EXIF location data. Of animated GIFs only the first frame is kept.
+type ImageOptions struct {
+	// MaxWidth and MaxHeight limit the dimensions of images, which are downsized keeping their
+	// aspect ratio. If zero, DefaultMaxImageDimension is used.
+	MaxWidth  int
+	MaxHeight int
+	// Quality is the JPEG quality from 1 to 100. If zero, DefaultJPEGQuality is used.
+	Quality int
+	// ThumbnailSize limits the width and height of thumbnails. If zero,
+	// DefaultThumbnailDimension is used.
+	ThumbnailSize int
+}
+
+func (o ImageOptions) maxDimensions() (int, int) {
+	w, h := o.MaxWidth, o.MaxHeight
+	if w <= 0 {
+		w = DefaultMaxImageDimension
+	}
+	if h <= 0 {
+		h = DefaultMaxImageDimension
+	}
+	return w, h
+}
+
+func (o ImageOptions) quality() int {
+	if o.Quality <= 0 || o.Quality > 100 {
+		return DefaultJPEGQuality
+	}
+	return o.Quality
+}
+
+func (o ImageOptions) thumbnailSize() int {
+	if o.ThumbnailSize <= 0 {
+		return DefaultThumbnailDimension
+	}
+	return o.ThumbnailSize
+}
+
+// Process decodes a JPEG, PNG or GIF image, downsizes it to the maximum dimensions and returns it
+// encoded as JPEG. If mimeType is empty, the format is detected from the image.
+func (o ImageOptions) Process(data []byte, mimeType string) ([]byte, error) {
+	w, h := o.maxDimensions()
+	return o.encode(data, mimeType, w, h)
+}
+
+// Thumbnail returns a JPEG preview of a JPEG, PNG or GIF image fitting into ThumbnailSize. It is a
+// standalone helper, none of the messages o3 sends carries a thumbnail.
+func (o ImageOptions) Thumbnail(data []byte, mimeType string) ([]byte, error) {
+	size := o.thumbnailSize()
+	return o.encode(data, mimeType, size, size)
+}
+
+func (o ImageOptions) encode(data []byte, mimeType string, maxWidth, maxHeight int) ([]byte, error) {
+	src, err := decodeImage(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	// the orientation is lost with the EXIF data, so it is applied to the pixels
+	img := orientImage(flattenImage(src), jpegOrientation(data))
+	w, h := fitDimensions(img.Rect.Dx(), img.Rect.Dy(), maxWidth, maxHeight)
+	dst := scaleImage(img, w, h)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: o.quality()}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeImage decodes an image after checking its type and dimensions
+func decodeImage(data []byte, mimeType string) (image.Image, error) {
+	if mimeType == "" {
+		// images are decoded by their content anyway
+		mimeType = http.DetectContentType(data)
+	}
+	if _, err := mediaType(data, mimeType, processableImageTypes); err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %s", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d not supported", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %s", err)
+	}
+	return img, nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, 1 if it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xFF {
+		marker := data[1]
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if marker == 0xDA || length < 2 || len(data) < 2+length {
+			// the metadata segments precede the image data
+			return 1
+		}
+		segment := data[4 : 2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		data = data[2+length:]
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF formatted EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := tiff[ifd+2+i*12:]
+		if len(entry) < 12 {
+			break
+		}
+		// a single SHORT value is stored in the first bytes of the value field
+		if order.Uint16(entry) == 0x0112 && order.Uint16(entry[2:]) == 3 {
+			if o := int(order.Uint16(entry[8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orientImage turns src the way EXIF orientation o says it has to be displayed
+func orientImage(src *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return src
+	}
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	w, h := sw, sh
+	if o >= 5 {
+		// orientations 5 to 8 swap width and height
+		w, h = sh, sw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored horizontally
+				sx, sy = sw-1-x, y
+			case 3: // rotated by 180 degrees
+				sx, sy = sw-1-x, sh-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, sh-1-y
+			case 5: // mirrored along the top left to bottom right diagonal
+				sx, sy = y, x
+			case 6: // needs rotating by 90 degrees clockwise
+				sx, sy = y, sh-1-x
+			case 7: // mirrored along the top right to bottom left diagonal
+				sx, sy = sw-1-y, sh-1-x
+			case 8: // needs rotating by 90 degrees counterclockwise
+				sx, sy = sw-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// fitDimensions returns the largest dimensions of the same aspect ratio as w x h that fit into
+// maxWidth x maxHeight. Images are never enlarged.
+func fitDimensions(w, h, maxWidth, maxHeight int) (int, int) {
+	if w <= maxWidth && h <= maxHeight {
+		return w, h
+	}
+	if w*maxHeight > h*maxWidth {
+		w, h = maxWidth, h*maxWidth/w
+	} else {
+		w, h = w*maxHeight/h, maxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// flattenImage draws src onto a white background, as JPEG has no transparency
+func flattenImage(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Over)
+	return dst
+}
+
+// scaleImage downsizes src to w x h by averaging the source pixels covered by each target pixel
+func scaleImage(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw == w && sh == h {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		// target pixels cover at least one source pixel, as images are never enlarged
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// prepareImage processes data using the ImageOptions of sc if set and checks its type. It returns
+// the image to upload and its MIME type.
+func (sc *SessionContext) prepareImage(data []byte, mimeType string) ([]byte, string, error) {
+	if sc.Images == nil {
+		mimeType, err := mediaType(data, mimeType, imageTypes)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, mimeType, nil
+	}
+	data, err := sc.Images.Process(data, mimeType)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/jpeg", nil
+}
@@ -0,0 +1,168 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestImageOptions(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var pngData, gifData bytes.Buffer
+	if err := png.Encode(&pngData, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ImageOptions{MaxWidth: 100, Quality: 90, ThumbnailSize: 40}
+	tests := []struct {
+		data     []byte
+		mimeType string
+		w, h     int
+		thumb    bool
+		alpha    bool
+	}{
+		{pngData.Bytes(), "", 100, 50, false, true},
+		{gifData.Bytes(), "image/gif", 100, 50, false, false},
+		{pngData.Bytes(), "image/png", 40, 20, true, true},
+	}
+	for _, tt := range tests {
+		process := opts.Process
+		if tt.thumb {
+			process = opts.Thumbnail
+		}
+		out, err := process(tt.data, tt.mimeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("processed to %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+		// the left half is red, the transparent right half becomes white
+		if r, g, _, _ := img.At(tt.w/4, tt.h/2).RGBA(); r < 0xe000 || g > 0x2000 {
+			t.Errorf("left half not red: %v", img.At(tt.w/4, tt.h/2))
+		}
+		if r, g, b, _ := img.At(tt.w*3/4, tt.h/2).RGBA(); tt.alpha && (r < 0xe000 || g < 0xe000 || b < 0xe000) {
+			t.Errorf("right half not white: %v", img.At(tt.w*3/4, tt.h/2))
+		}
+	}
+
+	if _, err := opts.Process([]byte("not an image"), ""); err == nil {
+		t.Error("text processed as image")
+	}
+	if _, err := opts.Process(pngData.Bytes(), "image/webp"); err == nil {
+		t.Error("unsupported type processed")
+	}
+	if w, h := fitDimensions(10, 5000, 1600, 1600); w != 3 || h != 1600 {
+		t.Errorf("fitted to %dx%d", w, h)
+	}
+
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ALICE001"), LSK: *sk, Contacts: NewAddressBook()})
+	sc.ID.Contacts.Add(ThreemaContact{ID: sc.ID.ID, LPK: *pk})
+	sc.Blobs = NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	sc.Blobs.UserAgent = "o3-test"
+	if im, err := NewImageMessageFromBytes(sc, "ALICE001", pngData.Bytes(), ""); err != nil || im.MediaType() != "image/png" {
+		t.Errorf("PNG sent without processing as %q: %v", im.MediaType(), err)
+	}
+	sc.Images = &opts
+	im, err := NewImageMessageFromBytes(sc, "ALICE001", pngData.Bytes(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := im.GetImageData(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != "jpeg" || cfg.Width != 100 || im.MediaType() != "image/jpeg" {
+		t.Errorf("sent %s image of width %d: %v", format, cfg.Width, err)
+	}
+}
+
+func TestImageOrientation(t *testing.T) {
+	// the left half is red and the right half blue
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 20 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, src, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	withOrientation := func(o byte, bigEndian bool) []byte {
+		tiff := []byte("II\x2a\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00" + string(o) + "\x00\x00\x00\x00\x00\x00\x00")
+		if bigEndian {
+			tiff = []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string(o) + "\x00\x00\x00\x00\x00\x00")
+		}
+		app1 := append([]byte("\xff\xe1\x00\x00Exif\x00\x00"), tiff...)
+		app1[2], app1[3] = byte((len(app1)-2)>>8), byte(len(app1)-2)
+		return append(append([]byte{0xff, 0xd8}, app1...), jpegData.Bytes()[2:]...)
+	}
+
+	tests := []struct {
+		orientation byte
+		bigEndian   bool
+		w, h        int
+		topLeftRed  bool
+	}{
+		{1, false, 40, 20, true},
+		{3, true, 40, 20, false},
+		{6, false, 20, 40, true},
+		{8, true, 20, 40, false},
+	}
+	for _, tt := range tests {
+		data := withOrientation(tt.orientation, tt.bigEndian)
+		if o := jpegOrientation(data); o != int(tt.orientation) {
+			t.Errorf("orientation %d read as %d", tt.orientation, o)
+		}
+		out, err := ImageOptions{Quality: 100}.Process(data, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: processed to %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if r, _, _, _ := img.At(2, 2).RGBA(); (r > 0x8000) != tt.topLeftRed {
+			t.Errorf("orientation %d: top left is %v", tt.orientation, img.At(2, 2))
+		}
+	}
+	if o := jpegOrientation(jpegData.Bytes()); o != 1 {
+		t.Errorf("orientation without EXIF data: %d", o)
+	}
+}
@@ -0,0 +1,100 @@
+package o3
+
+import "errors"
+
+// LinkEmail links the email address to thid. The server sends a verification mail to the address,
+// the link is established once the link in the mail has been followed. It reports whether the
+// address was already linked. An empty address removes the link, see UnlinkEmail, and linked then
+// reports whether no address was linked.
+func (tr ThreemaRest) LinkEmail(thid ThreemaID, email string, language string) (linked bool, err error) {
+	request := struct {
+		Identity string `json:"identity"`
+		Email    string `json:"email"`
+		Language string `json:"language"`
+	}{thid.String(), email, language}
+
+	var status struct {
+		Linked bool `json:"linked"`
+	}
+	// the server answers without a challenge if the address is linked already
+	challenge, err := tr.requestChallenge("identity/link_email", request, &status)
+	if status.Linked {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, tr.answerChallenge("identity/link_email", request, challenge, &thid.LSK, nil)
+}
+
+// UnlinkEmail removes the email address linked to thid
+func (tr ThreemaRest) UnlinkEmail(thid ThreemaID) error {
+	_, err := tr.LinkEmail(thid, "", "")
+	return err
+}
+
+// LinkMobileNo starts linking the phone number, given in international format without '+', to
+// thid. The server sends an SMS with a code that has to be submitted using VerifyMobileNo together
+// with the returned verification ID. An empty number removes the link, see UnlinkMobileNo.
+func (tr ThreemaRest) LinkMobileNo(thid ThreemaID, mobileNo string, language string) (verificationID string, err error) {
+	request := struct {
+		Identity string `json:"identity"`
+		MobileNo string `json:"mobileNo"`
+		Language string `json:"language"`
+	}{thid.String(), mobileNo, language}
+
+	var status struct {
+		Linked bool `json:"linked"`
+	}
+	challenge, err := tr.requestChallenge("identity/link_mobileno", request, &status)
+	if status.Linked {
+		if mobileNo == "" {
+			// no number was linked
+			return "", nil
+		}
+		return "", errors.New("mobile number is already linked")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		VerificationID string `json:"verificationId"`
+	}
+	err = tr.answerChallenge("identity/link_mobileno", request, challenge, &thid.LSK, &result)
+	return result.VerificationID, err
+}
+
+// UnlinkMobileNo removes the phone number linked to thid. Nothing has to be verified.
+func (tr ThreemaRest) UnlinkMobileNo(thid ThreemaID) error {
+	_, err := tr.LinkMobileNo(thid, "", "")
+	return err
+}
+
+// VerifyMobileNo completes linking a phone number by submitting the code received by SMS or call
+func (tr ThreemaRest) VerifyMobileNo(verificationID string, code string) error {
+	request := struct {
+		VerificationID string `json:"verificationId"`
+		Code           string `json:"code"`
+	}{verificationID, code}
+
+	var result apiResult
+	if err := tr.postJSON("identity/link_mobileno_code", request, &result); err != nil {
+		return err
+	}
+	return result.err("verifying mobile number")
+}
+
+// RequestVerificationCall asks the server to deliver the verification code of a pending phone
+// number link by a call instead of SMS
+func (tr ThreemaRest) RequestVerificationCall(verificationID string) error {
+	request := struct {
+		VerificationID string `json:"verificationId"`
+	}{verificationID}
+
+	var result apiResult
+	if err := tr.postJSON("identity/link_mobileno_call", request, &result); err != nil {
+		return err
+	}
+	return result.err("requesting verification call")
+}
@@ -0,0 +1,49 @@
+package o3
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// UnsupportedMediaType is returned when media of a type a message cannot carry is attached to it
+type UnsupportedMediaType struct {
+	Type string
+	Want []string
+}
+
+func (umt UnsupportedMediaType) Error() string {
+	return fmt.Sprintf("unsupported media type %s, want %s", umt.Type, strings.Join(umt.Want, " or "))
+}
+
+// imageTypes are the MIME types of images that can be sent, the apps render all of them
+var imageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// audioTypes are the MIME types of audio that can be sent
+var audioTypes = []string{"audio/mp4", "audio/aac", "audio/x-m4a", "audio/m4a", "audio/mpeg", "audio/ogg", "audio/opus", "application/ogg"}
+
+// mediaType checks the MIME type of data against accepted. If mimeType is empty it is detected
+// from the content, media of unknown type is accepted as-is then.
+func mediaType(data []byte, mimeType string, accepted []string) (string, error) {
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+		switch mimeType {
+		case "application/octet-stream":
+			return mimeType, nil
+		case "video/mp4":
+			// M4A audio is detected as MP4 video, it is the same container
+			mimeType = "audio/mp4"
+		}
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", fmt.Errorf("invalid media type %q: %s", mimeType, err)
+	}
+	for _, t := range accepted {
+		if mediaType == t {
+			return mediaType, nil
+		}
+	}
+	return "", UnsupportedMediaType{Type: mediaType, Want: accepted}
+}
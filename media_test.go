@@ -0,0 +1,251 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestMediaType(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	m4a := []byte("\x00\x00\x00\x18ftypM4A \x00\x00\x00\x00M4A mp42isom")
+	tests := []struct {
+		data     []byte
+		mimeType string
+		accepted []string
+		want     string
+		ok       bool
+	}{
+		{jpeg, "", imageTypes, "image/jpeg", true},
+		{jpeg, "image/jpeg", imageTypes, "image/jpeg", true},
+		{png, "", imageTypes, "image/png", true},
+		{gif, "", imageTypes, "image/gif", true},
+		{jpeg, "image/tiff", imageTypes, "", false},
+		{png, "", audioTypes, "", false},
+		{[]byte("OggS"), "audio/ogg; codecs=opus", audioTypes, "audio/ogg", true},
+		{[]byte("unknown"), "", audioTypes, "text/plain; charset=utf-8", false},
+		{[]byte{0, 1, 2, 3}, "", audioTypes, "application/octet-stream", true},
+		{jpeg, "image/", imageTypes, "", false},
+		{m4a, "", audioTypes, "audio/mp4", true},
+	}
+	for _, tt := range tests {
+		got, err := mediaType(tt.data, tt.mimeType, tt.accepted)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("mediaType(%q, %q) = %q, %v", tt.data, tt.mimeType, got, err)
+		}
+	}
+}
+
+func TestMediaFromMemory(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	bc := NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	bc.UserAgent = "o3-test"
+	newSession := func(id string) (*SessionContext, *[32]byte) {
+		pk, sk, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := NewSessionContext(ThreemaID{ID: NewIDString(id), LSK: *sk, Contacts: NewAddressBook()})
+		sc.Blobs = bc
+		return sc, pk
+	}
+	alice, alicePK := newSession("ALICE001")
+	bob, bobPK := newSession("BOB00001")
+	alice.ID.Contacts.Add(ThreemaContact{ID: bob.ID.ID, LPK: *bobPK})
+	bob.ID.Contacts.Add(ThreemaContact{ID: alice.ID.ID, LPK: *alicePK})
+
+	chart := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00 a rendered chart")
+	im, err := NewImageMessageFromReader(alice, "BOB00001", bytes.NewReader(chart), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err := im.GetImageData(bob); err != nil || !bytes.Equal(image, chart) {
+		t.Errorf("image data: %q, %v", image, err)
+	}
+	if im.MediaType() != "image/jpeg" {
+		t.Errorf("image sent as %q", im.MediaType())
+	}
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewImageMessageFromBytes(alice, "BOB00001", pngData.Bytes(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err := pm.GetImageData(bob); err != nil || !bytes.Equal(image, pngData.Bytes()) || pm.MediaType() != "image/png" {
+		t.Errorf("PNG image data: %q, %v, sent as %q", image, err, pm.MediaType())
+	}
+	if _, err := NewImageMessageFromBytes(alice, "BOB00001", []byte("just text"), ""); err == nil {
+		t.Error("text sent as image")
+	}
+
+	if _, err := NewAudioMessageFromBytes(alice, "BOB00001", chart, "image/jpeg"); err == nil {
+		t.Error("image sent as audio")
+	}
+	am, err := NewAudioMessageFromBytes(alice, "BOB00001", []byte("ID3 voice"), "audio/mpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio, err := am.GetAudioData(bob); err != nil || string(audio) != "ID3 voice" || am.MediaType() != "audio/mpeg" {
+		t.Errorf("audio data: %q, %v, sent as %q", audio, err, am.MediaType())
+	}
+
+	group := Group{CreatorID: alice.ID.ID, GroupID: [8]byte{1}, Members: []IDString{alice.ID.ID, bob.ID.ID}}
+	gms, err := NewGroupManageSetImageMessagesFromBytes(alice, group, chart, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err := gms[1].GetImageData(bob); err != nil || !bytes.Equal(image, chart) {
+		t.Errorf("group image data: %q, %v", image, err)
+	}
+
+	bc.MaxSize = 100
+	alice.Blobs = bc
+	if _, err := NewImageMessageFromReader(alice, "BOB00001", bytes.NewReader(make([]byte, 200)), "image/jpeg"); err == nil {
+		t.Error("image exceeding the size limit read")
+	}
+}
+
+func TestGroupImageMessages(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+	fa := newFakeAPI()
+	api := httptest.NewServer(fa.handler(t))
+	defer api.Close()
+
+	bc := NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	bc.UserAgent = "o3-test"
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ALICE001"), Contacts: NewAddressBook()})
+	sc.Blobs = bc
+	sc.Rest = NewThreemaRest(api.URL, api.Client())
+
+	members := []IDString{NewIDString("BOB00001"), NewIDString("CAROL001"), NewIDString("DAVE0001")}
+	for i, id := range members {
+		pk, _, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mask := DefaultFeatureMask
+		if i == 2 {
+			mask = FEATUREAUDIO
+		}
+		sc.ID.Contacts.Add(ThreemaContact{ID: id, LPK: *pk, FeatureMask: mask})
+		fa.keys[id.String()] = *pk
+		fa.masks[id.String()] = mask
+	}
+	group := Group{CreatorID: sc.ID.ID, GroupID: [8]byte{7}, Members: members}
+
+	filename := filepath.Join(t.TempDir(), "chart.jpg")
+	image := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00 a rendered chart")
+	if err := ioutil.WriteFile(filename, image, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gims, err := NewGroupImageMessages(sc, group, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.blobs) != 1 {
+		t.Errorf("image uploaded %d times", len(fb.blobs))
+	}
+	for i, gim := range gims {
+		if gim.Recipient() != members[i] || gim.BlobID != gims[0].BlobID || gim.Key != gims[0].Key || gim.GroupID() != group.GroupID {
+			t.Errorf("unexpected message %d: %#v", i, gim)
+		}
+	}
+	sent := GroupImageMessage{groupImageMessageBody: parseGroupImageMessage(bytes.NewBuffer(gims[0].Serialize()[1+8+8:]))}
+	if data, err := sent.GetImageData(sc); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("group image data: %q, %v", data, err)
+	}
+
+	fb.blobs = make(map[string][]byte)
+	msgs := make(chan Message, 10)
+	if err, ok := sc.SendGroupImageMessage(group, filename, msgs).(UnsupportedFeature); !ok || err.ID != members[2] {
+		t.Errorf("unexpected error sending to a member without group support: %v", err)
+	}
+	if len(msgs) != 0 || len(fb.blobs) != 0 {
+		t.Errorf("sent %d images using %d blobs to a member without group support", len(msgs), len(fb.blobs))
+	}
+
+	group.Members = members[:2]
+	if err := sc.SendGroupImageMessage(group, filename, msgs); err != nil {
+		t.Fatal(err)
+	}
+	close(msgs)
+	var shared int
+	for msg := range msgs {
+		if _, ok := msg.(GroupImageMessage); ok {
+			shared++
+		}
+	}
+	if shared != 2 || len(fb.blobs) != 1 {
+		t.Errorf("sent %d group images using %d blobs", shared, len(fb.blobs))
+	}
+}
+
+func TestMediaFromFiles(t *testing.T) {
+	fb := &fakeBlobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fb)
+	defer srv.Close()
+
+	pk, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("ALICE001"), Contacts: NewAddressBook()})
+	sc.Blobs = NewBlobClient(srv.URL+"/upload", srv.URL+"/{prefix}/{blobId}", srv.Client())
+	sc.Blobs.UserAgent = "o3-test"
+	sc.ID.Contacts.Add(ThreemaContact{ID: NewIDString("BOB00001"), LPK: *pk})
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "avatar.png")
+	if err := ioutil.WriteFile(filename, pngData.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are checked by their content, whatever their extension says
+	im, err := NewImageMessage(sc, "BOB00001", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.MediaType() != "image/png" {
+		t.Errorf("image file sent as %q", im.MediaType())
+	}
+	if err := im.SetImageData(filename, sc); err != nil {
+		t.Error(err)
+	}
+	group := Group{CreatorID: sc.ID.ID, GroupID: [8]byte{1}, Members: []IDString{NewIDString("BOB00001")}}
+	if _, err := NewGroupManageSetImageMessages(sc, group, filename); err != nil {
+		t.Error(err)
+	}
+	textFile := filepath.Join(t.TempDir(), "notes.jpg")
+	if err := ioutil.WriteFile(textFile, []byte("not an image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewImageMessage(sc, "BOB00001", textFile); err == nil {
+		t.Error("text file sent as image")
+	}
+
+	m4a := append(mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00M4A mp42isom")), mp4Atom("mdat", make([]byte, 64))...)
+	if _, err := NewAudioMessageFromBytes(sc, "BOB00001", m4a, ""); err != nil {
+		t.Errorf("M4A audio: %v", err)
+	}
+}
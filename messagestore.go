@@ -0,0 +1,400 @@
+package o3
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoredMessage is a sent or received message as kept by a MessageStore
+type StoredMessage struct {
+	// Conversation is the chat the message belongs to, see ContactConversation and
+	// GroupConversation
+	Conversation string
+	ID           uint64
+	Sender       IDString
+	Recipient    IDString
+	Time         time.Time
+	PubNick      PubNick
+	Type         MsgType
+	// Outgoing is set for messages we sent
+	Outgoing bool
+	// Status is the status of the latest delivery receipt of an outgoing message, or zero
+	Status MsgStatus
+	// Body is the serialized message as returned by Serialize
+	Body []byte
+	// CopyOf is set on the further copies of a group message we sent to the other members. They
+	// carry no body and are left out by Query, receipts for them update the message with ID CopyOf.
+	CopyOf uint64
+}
+
+// Message decodes the stored message
+func (sm StoredMessage) Message() (Message, error) {
+	return decodeMessage(messagePacket{
+		Sender:    sm.Sender,
+		Recipient: sm.Recipient,
+		ID:        sm.ID,
+		Time:      sm.Time,
+		PubNick:   sm.PubNick,
+		Plaintext: sm.Body})
+}
+
+// MessageStore keeps the history of conversations. Implementations must be safe for concurrent use.
+type MessageStore interface {
+	// Append adds a message to the history. Messages already stored, identified by their
+	// conversation, sender and ID, are ignored.
+	Append(sm StoredMessage) error
+	// Query returns the messages of a conversation sent at or after from and before to, ordered
+	// by time. A zero from or to leaves that end of the range open.
+	Query(conversation string, from, to time.Time) ([]StoredMessage, error)
+	// UpdateStatus sets the status of the message with the given ID we sent to peer, directly or
+	// as a copy of a group message
+	UpdateStatus(peer IDString, msgID uint64, status MsgStatus) error
+}
+
+// ContactConversation returns the conversation of the chat with the given contact
+func ContactConversation(id IDString) string {
+	return id.String()
+}
+
+// GroupConversation returns the conversation of the chat of a group
+func GroupConversation(creator IDString, groupID [8]byte) string {
+	return creator.String() + ":" + hex.EncodeToString(groupID[:])
+}
+
+// newStoredMessage prepares m for a MessageStore of self. Receipts and typing notifications are
+// not part of the history and return false. The copies of a group message we sent after the first
+// one are returned without body, see CopyOf.
+func newStoredMessage(m Message, self IDString) (StoredMessage, bool) {
+	mh := m.header()
+	sm := StoredMessage{
+		ID:        mh.id,
+		Sender:    mh.sender,
+		Recipient: mh.recipient,
+		Time:      mh.time,
+		PubNick:   mh.pubNick,
+		Outgoing:  mh.sender == self,
+	}
+	switch gm := m.(type) {
+	case DeliveryReceiptMessage, TypingNotificationMessage:
+		return StoredMessage{}, false
+	case interface {
+		GroupCreator() IDString
+		GroupID() [8]byte
+	}:
+		sm.Conversation = GroupConversation(gm.GroupCreator(), gm.GroupID())
+	case interface{ GroupID() [8]byte }:
+		// only the creator manages a group
+		sm.Conversation = GroupConversation(mh.sender, gm.GroupID())
+	default:
+		if sm.Outgoing {
+			sm.Conversation = ContactConversation(mh.recipient)
+		} else {
+			sm.Conversation = ContactConversation(mh.sender)
+		}
+	}
+	if fc, ok := m.(interface{ firstCopy(uint64) uint64 }); ok {
+		if first := fc.firstCopy(mh.id); first != mh.id {
+			sm.CopyOf = first
+			return sm, true
+		}
+	}
+	sm.Body = m.Serialize()
+	sm.Type = MsgType(sm.Body[0])
+	return sm, true
+}
+
+// recordMessage adds a sent or received message to the history if sc has a MessageStore and
+// applies delivery receipts to it. Errors are reported on ErrorChan without blocking the session.
+func (sc *SessionContext) recordMessage(m Message) {
+	if sc.Messages == nil {
+		return
+	}
+	var err error
+	if dm, ok := m.(DeliveryReceiptMessage); ok {
+		if dm.Sender() != sc.ID.ID {
+			err = sc.Messages.UpdateStatus(dm.Sender(), dm.MsgID(), dm.Status())
+		}
+	} else if sm, ok := newStoredMessage(m, sc.ID.ID); ok {
+		err = sc.Messages.Append(sm)
+	}
+	if err != nil {
+		select {
+		case sc.ErrorChan <- err:
+		default:
+		}
+	}
+}
+
+// FileMessageStore is a MessageStore keeping each conversation in an append-only file of JSON
+// lines. Status updates are appended as well and replace the status of earlier lines when read.
+type FileMessageStore struct {
+	dir string
+	mu  sync.Mutex
+	// indexes hold the messages of the conversations accessed so far
+	indexes map[string]*conversationIndex
+	// indexedAll is set once the files of all conversations have been indexed
+	indexedAll bool
+}
+
+type messageKey struct {
+	sender IDString
+	id     uint64
+}
+
+type conversationIndex struct {
+	stored map[messageKey]bool
+	sent   map[uint64]bool
+}
+
+func (ci *conversationIndex) add(sm StoredMessage) {
+	ci.stored[messageKey{sm.Sender, sm.ID}] = true
+	if sm.Outgoing {
+		ci.sent[sm.ID] = true
+	}
+}
+
+// messageLine is a line of a conversation file. Lines without a body are written as statusLine
+// and update the status of the outgoing message with their ID.
+type messageLine struct {
+	ID        uint64    `json:"id"`
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Time      time.Time `json:"time"`
+	Nickname  string    `json:"nickname,omitempty"`
+	Type      MsgType   `json:"type,omitempty"`
+	Outgoing  bool      `json:"outgoing,omitempty"`
+	Status    MsgStatus `json:"status,omitempty"`
+	Body      []byte    `json:"body,omitempty"`
+	CopyOf    uint64    `json:"copyOf,omitempty"`
+}
+
+type statusLine struct {
+	ID     uint64    `json:"id"`
+	Status MsgStatus `json:"status"`
+}
+
+// NewFileMessageStore returns a FileMessageStore keeping its files in dir, which is created if
+// necessary
+func NewFileMessageStore(dir string) (*FileMessageStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileMessageStore{dir: dir, indexes: make(map[string]*conversationIndex)}, nil
+}
+
+func (fs *FileMessageStore) path(conversation string) string {
+	return filepath.Join(fs.dir, "c-"+hex.EncodeToString([]byte(conversation))+".jsonl")
+}
+
+// Append adds a message to the file of its conversation
+func (fs *FileMessageStore) Append(sm StoredMessage) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ci, err := fs.index(sm.Conversation)
+	if err != nil {
+		return err
+	}
+	if ci.stored[messageKey{sm.Sender, sm.ID}] {
+		return nil
+	}
+	err = fs.appendLine(sm.Conversation, messageLine{
+		ID:        sm.ID,
+		Sender:    sm.Sender.String(),
+		Recipient: sm.Recipient.String(),
+		Time:      sm.Time,
+		Nickname:  strings.TrimRight(sm.PubNick.String(), "\x00"),
+		Type:      sm.Type,
+		Outgoing:  sm.Outgoing,
+		Status:    sm.Status,
+		Body:      sm.Body,
+		CopyOf:    sm.CopyOf})
+	if err == nil {
+		ci.add(sm)
+	}
+	return err
+}
+
+// Query returns the messages of a conversation within the given time range
+func (fs *FileMessageStore) Query(conversation string, from, to time.Time) ([]StoredMessage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	all, err := fs.read(conversation)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []StoredMessage
+	for _, sm := range all {
+		if sm.CopyOf != 0 {
+			continue
+		}
+		if (from.IsZero() || !sm.Time.Before(from)) && (to.IsZero() || sm.Time.Before(to)) {
+			msgs = append(msgs, sm)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+	return msgs, nil
+}
+
+// UpdateStatus records the status of a message sent to peer. Messages not found in the chat with
+// peer are looked up in all conversations, as they may have been sent to a group. Unknown messages
+// are ignored.
+func (fs *FileMessageStore) UpdateStatus(peer IDString, msgID uint64, status MsgStatus) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	conversation := ContactConversation(peer)
+	ci, err := fs.index(conversation)
+	if err != nil {
+		return err
+	}
+	if !ci.sent[msgID] {
+		if conversation, err = fs.findSent(msgID); err != nil || conversation == "" {
+			return err
+		}
+	}
+	return fs.appendLine(conversation, statusLine{ID: msgID, Status: status})
+}
+
+// findSent returns the conversation of the message with the given ID we sent, or "" if there is
+// none. The files of all conversations are indexed on first use.
+func (fs *FileMessageStore) findSent(msgID uint64) (string, error) {
+	if !fs.indexedAll {
+		files, err := filepath.Glob(filepath.Join(fs.dir, "c-*.jsonl"))
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			conversation, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "c-"), ".jsonl"))
+			if err != nil {
+				continue
+			}
+			if _, err := fs.index(string(conversation)); err != nil {
+				return "", err
+			}
+		}
+		fs.indexedAll = true
+	}
+	for conversation, ci := range fs.indexes {
+		if ci.sent[msgID] {
+			return conversation, nil
+		}
+	}
+	return "", nil
+}
+
+// index returns the index of a conversation, reading its file on first use
+func (fs *FileMessageStore) index(conversation string) (*conversationIndex, error) {
+	if ci, ok := fs.indexes[conversation]; ok {
+		return ci, nil
+	}
+	msgs, err := fs.read(conversation)
+	if err != nil {
+		return nil, err
+	}
+	ci := &conversationIndex{stored: make(map[messageKey]bool), sent: make(map[uint64]bool)}
+	for _, sm := range msgs {
+		ci.add(sm)
+	}
+	fs.indexes[conversation] = ci
+	return ci, nil
+}
+
+// read returns all messages of a conversation in file order with their latest status
+func (fs *FileMessageStore) read(conversation string) ([]StoredMessage, error) {
+	f, err := os.Open(fs.path(conversation))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []StoredMessage
+	// outgoing maps the IDs of sent messages and their copies to the message their status is kept in
+	outgoing := make(map[uint64]int)
+	r := bufio.NewReader(f)
+	for eof := false; !eof; {
+		data, err := readLine(r, maxLineLength)
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return nil, err
+		}
+		var line messageLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			// a line cut short by a crash or too long to read, the lines after it are still good
+			continue
+		}
+		if len(line.Body) == 0 && line.CopyOf == 0 {
+			if i, ok := outgoing[line.ID]; ok {
+				msgs[i].Status = line.Status
+			}
+			continue
+		}
+		if line.Outgoing {
+			i, ok := outgoing[line.CopyOf]
+			if line.CopyOf == 0 || !ok {
+				i = len(msgs)
+			}
+			outgoing[line.ID] = i
+		}
+		msgs = append(msgs, StoredMessage{
+			Conversation: conversation,
+			ID:           line.ID,
+			Sender:       NewIDString(line.Sender),
+			Recipient:    NewIDString(line.Recipient),
+			Time:         line.Time,
+			PubNick:      NewPubNick(line.Nickname),
+			Type:         line.Type,
+			Outgoing:     line.Outgoing,
+			Status:       line.Status,
+			Body:         line.Body,
+			CopyOf:       line.CopyOf})
+	}
+	return msgs, nil
+}
+
+// maxLineLength is the length of the longest line read from a conversation file. Messages are far
+// shorter, longer lines can only be damaged and are skipped.
+const maxLineLength = 1 << 20
+
+// readLine returns the next line of r including its newline. Lines longer than max are consumed
+// and returned empty.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) <= max {
+			line = append(line, chunk...)
+		} else {
+			line, tooLong = nil, true
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func (fs *FileMessageStore) appendLine(conversation string, line interface{}) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.path(conversation), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
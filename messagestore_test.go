@@ -0,0 +1,238 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestFileMessageStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self, peer := NewIDString("ALICE001"), NewIDString("BOB00001")
+	sc := NewSessionContext(ThreemaID{ID: self, Nick: NewPubNick("alice"), Contacts: NewAddressBook()})
+	start := time.Unix(1500000000, 0)
+	msgs := make([]TextMessage, 3)
+	for i := range msgs {
+		tm, err := NewTextMessage(sc, peer.String(), string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm.time = start.Add(time.Duration(2-i) * time.Minute)
+		if i == 1 {
+			tm.sender, tm.recipient = peer, self
+		}
+		msgs[i] = tm
+	}
+	for _, tm := range append(msgs, msgs[0]) {
+		sm, ok := newStoredMessage(tm, self)
+		if !ok {
+			t.Fatal("text message not stored")
+		}
+		if err := store.Append(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.UpdateStatus(peer, msgs[0].ID(), MSGREAD); err != nil {
+		t.Fatal(err)
+	}
+	// receipts for messages we did not send are ignored
+	if err := store.UpdateStatus(peer, msgs[1].ID(), MSGREAD); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reopened store reads the history back
+	store, err = NewFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := store.Query(ContactConversation(peer), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("got %d messages, want 3", len(history))
+	}
+	for i, sm := range history {
+		want := msgs[2-i]
+		m, err := sm.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm, ok := m.(TextMessage)
+		if !ok || tm.Text() != want.Text() || sm.ID != want.ID() || !sm.Time.Equal(want.Time()) || sm.Outgoing != (want.Sender() == self) {
+			t.Errorf("message %d: %#v", i, sm)
+		}
+	}
+	if history[2].Status != MSGREAD || history[1].Status != 0 || history[0].Type != TEXTMESSAGE {
+		t.Errorf("unexpected status or type: %#v", history)
+	}
+
+	ranged, err := store.Query(ContactConversation(peer), start.Add(time.Minute), start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranged) != 1 || ranged[0].ID != msgs[1].ID() {
+		t.Errorf("range query returned %#v", ranged)
+	}
+	if err := store.Append(StoredMessage{Conversation: ContactConversation(peer), ID: msgs[1].ID(), Sender: peer, Body: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := store.Query(ContactConversation(peer), time.Time{}, time.Time{}); len(history) != 3 {
+		t.Errorf("duplicate stored after reopening, %d messages", len(history))
+	}
+
+	group := Group{CreatorID: peer, GroupID: [8]byte{3}, Members: []IDString{peer, self, NewIDString("CAROL001")}}
+	gtms, err := NewGroupTextMessages(sc, group, "hello group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtms[0].ID() == gtms[1].ID() {
+		t.Error("members get copies sharing a message ID")
+	}
+	// Only the first copy of a group message we send is part of the history, the others map
+	// receipts to it
+	for i, gtm := range gtms {
+		sm, ok := newStoredMessage(gtm, self)
+		if !ok || (sm.CopyOf == 0) != (i == 0) || (i > 0 && sm.CopyOf != gtms[0].ID()) {
+			t.Errorf("copy %d stored as copy of %x: %v", i, sm.CopyOf, ok)
+		}
+		if sm.Conversation != GroupConversation(peer, group.GroupID) {
+			t.Errorf("group message stored in %s", sm.Conversation)
+		}
+		if err := store.Append(sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a reopened store finds the group message a receipt belongs to
+	store, err = NewFileMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateStatus(NewIDString("CAROL001"), gtms[2].ID(), MSGAPPROVED); err != nil {
+		t.Fatal(err)
+	}
+	history, err = store.Query(GroupConversation(peer, group.GroupID), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].ID != gtms[0].ID() || history[0].Status != MSGAPPROVED {
+		t.Errorf("unexpected group history: %#v", history)
+	}
+}
+
+func TestFileMessageStoreLongLine(t *testing.T) {
+	store, err := NewFileMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := ContactConversation(NewIDString("BOB00001"))
+	add := func(id uint64) {
+		err := store.Append(StoredMessage{Conversation: conversation, ID: id, Sender: NewIDString("BOB00001"), Time: time.Unix(int64(id), 0), Body: []byte{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(1)
+	if err := store.appendLine(conversation, messageLine{ID: 2, Body: make([]byte, maxLineLength)}); err != nil {
+		t.Fatal(err)
+	}
+	add(3)
+
+	store, err = NewFileMessageStore(store.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := store.Query(conversation, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].ID != 1 || history[1].ID != 3 {
+		t.Errorf("unexpected history: %#v", history)
+	}
+}
+
+func TestSessionMessageStore(t *testing.T) {
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := ThreemaContact{ID: NewIDString("TESTPEER"), LPK: *peerPK}
+	tid, err := NewThreemaID("TESTSELF", [32]byte{7}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Contacts.Add(peer)
+	sc := NewSessionContext(tid)
+	if sc.Messages, err = NewFileMessageStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	fs := newFakeServer(t, sc)
+	// one sent message and acks for two received ones
+	go fs.countFrames(3)
+	go sc.receiveLoop()
+	fs.send(t, serializePktType(new(bytes.Buffer), connEstablished).Bytes())
+
+	deliver := func(m Message) {
+		n := newRandomNonce()
+		mh := m.header()
+		fs.send(t, serializeMsgPkt(messagePacket{
+			PktType:    deliveringMsg,
+			Sender:     mh.sender,
+			Recipient:  mh.recipient,
+			ID:         mh.id,
+			Time:       mh.time,
+			Nonce:      n,
+			Ciphertext: box.Seal(nil, m.Serialize(), n.bytes(), tid.GetPubKey(), peerSK),
+		}).Bytes())
+		select {
+		case rmsg := <-sc.receiveMsgChan.Out:
+			if rmsg.Err != nil {
+				t.Fatal(rmsg.Err)
+			}
+		case err := <-sc.ErrorChan:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+	conversation := ContactConversation(peer.ID)
+	waitFor := func(n int) []StoredMessage {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if history, err := sc.Messages.Query(conversation, time.Time{}, time.Time{}); err != nil {
+				t.Fatal(err)
+			} else if len(history) >= n {
+				return history
+			}
+		}
+		t.Fatalf("history did not reach %d messages", n)
+		return nil
+	}
+
+	sent, err := NewTextMessage(sc, peer.String(), "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.sendMsgChan.In <- sent
+	waitFor(1)
+
+	deliver(TextMessage{
+		messageHeader{sender: peer.ID, recipient: tid.ID, id: 42, time: time.Now().Add(time.Second)},
+		textMessageBody{text: "pong"}})
+	deliver(DeliveryReceiptMessage{
+		messageHeader{sender: peer.ID, recipient: tid.ID, id: 43, time: time.Now()},
+		deliveryReceiptMessageBody{status: MSGREAD, msgID: sent.ID()}})
+
+	history := waitFor(2)
+	if len(history) != 2 || !history[0].Outgoing || history[0].Status != MSGREAD || history[1].Outgoing || history[1].ID != 42 {
+		t.Errorf("unexpected history: %#v", history)
+	}
+}
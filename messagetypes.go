@@ -2,11 +2,10 @@ package o3
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	mrand "math/rand"
+	"sync"
 	"time"
-
-	"errors"
 )
 
 // MsgType determines the type of message that is sent or received. Users usually
@@ -133,7 +132,10 @@ type TextMessage struct {
 
 // NewTextMessage returns a TextMessage ready to be encrypted
 func NewTextMessage(sc *SessionContext, recipient string, text string) (TextMessage, error) {
-	recipientID := NewIDString(recipient)
+	recipientID, err := ParseIDString(recipient)
+	if err != nil {
+		return TextMessage{}, err
+	}
 
 	tm := TextMessage{
 		messageHeader{
@@ -181,11 +183,41 @@ type imageMessageBody struct {
 	ServerID byte
 	Size     uint32
 	Nonce    nonce
+	mimeType string
+}
+
+// MediaType returns the MIME type of the image as checked when it was set. It is not transmitted,
+// so it is empty for received messages.
+func (im imageMessageBody) MediaType() string {
+	return im.mimeType
 }
 
 // NewImageMessage returns a ImageMessage ready to be encrypted
 func NewImageMessage(sc *SessionContext, recipient string, filename string) (ImageMessage, error) {
-	recipientID := NewIDString(recipient)
+	image, err := sc.Blobs.readFile(filename)
+	if err != nil {
+		return ImageMessage{}, fmt.Errorf("could not load image: %s", err)
+	}
+	return NewImageMessageFromBytes(sc, recipient, image, "")
+}
+
+// NewImageMessageFromReader returns a ImageMessage carrying the image read from r. If mimeType is
+// empty, it is detected from the image.
+func NewImageMessageFromReader(sc *SessionContext, recipient string, r io.Reader, mimeType string) (ImageMessage, error) {
+	image, err := sc.Blobs.readMedia(r)
+	if err != nil {
+		return ImageMessage{}, fmt.Errorf("could not read image: %s", err)
+	}
+	return NewImageMessageFromBytes(sc, recipient, image, mimeType)
+}
+
+// NewImageMessageFromBytes returns a ImageMessage carrying image. If mimeType is empty, it is
+// detected from the image.
+func NewImageMessageFromBytes(sc *SessionContext, recipient string, image []byte, mimeType string) (ImageMessage, error) {
+	recipientID, err := ParseIDString(recipient)
+	if err != nil {
+		return ImageMessage{}, err
+	}
 
 	im := ImageMessage{
 		messageHeader{
@@ -197,7 +229,7 @@ func NewImageMessage(sc *SessionContext, recipient string, filename string) (Ima
 		},
 		imageMessageBody{},
 	}
-	err := im.SetImageData(filename, *sc)
+	err = im.SetImageBytes(image, mimeType, sc)
 	if err != nil {
 		return ImageMessage{}, err
 	}
@@ -210,18 +242,36 @@ func (im ImageMessage) GetPrintableContent() string {
 }
 
 // GetImageData return the decrypted Image needs the recipients secret key
-func (im ImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptAsym(sc, im.BlobID, im.Sender().String(), im.Nonce)
+func (im ImageMessage) GetImageData(sc *SessionContext) ([]byte, error) {
+	return sc.cachedMedia(im.BlobID, boxSecret(im.Sender(), im.Nonce), func() ([]byte, error) {
+		data, err := downloadAndDecryptAsym(sc, im.BlobID, im.Sender().String(), im.Nonce)
+		if err == nil && sc.Blobs.AutoMarkDone {
+			// The image is already decrypted, failing to clean up the server is not worth an error
+			sc.Blobs.MarkDone(im.BlobID)
+		}
+		return data, err
+	})
 }
 
 // SetImageData encrypts and uploads the image. Sets the blob info in the ImageMessage. Needs the recipients public key.
-func (im *ImageMessage) SetImageData(filename string, sc SessionContext) error {
-	plainImage, err := ioutil.ReadFile(filename)
+func (im *ImageMessage) SetImageData(filename string, sc *SessionContext) error {
+	plainImage, err := sc.Blobs.readFile(filename)
 	if err != nil {
-		return errors.New("could not load image")
+		return fmt.Errorf("could not load image: %s", err)
 	}
+	return im.SetImageBytes(plainImage, "", sc)
+}
 
-	im.Nonce, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadAsym(sc, plainImage, im.recipient.String())
+// SetImageBytes encrypts and uploads image like SetImageData. If mimeType is empty, it is detected
+// from the image.
+func (im *ImageMessage) SetImageBytes(image []byte, mimeType string, sc *SessionContext) error {
+	image, mimeType, err := sc.prepareImage(image, mimeType)
+	if err != nil {
+		return err
+	}
+	im.mimeType = mimeType
+
+	im.Nonce, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadAsym(sc, image, im.recipient.String())
 
 	return err
 }
@@ -240,16 +290,46 @@ type AudioMessage struct {
 }
 
 type audioMessageBody struct {
-	Duration uint16 // The audio clips duration in seconds
+	Duration uint16 // The audio clips duration in seconds or AudioDurationUnknown
 	BlobID   [16]byte
 	ServerID byte
 	Size     uint32
 	Key      [32]byte
+	mimeType string
+}
+
+// MediaType returns the MIME type of the audio as checked when it was set. It is not transmitted,
+// so it is empty for received messages.
+func (am audioMessageBody) MediaType() string {
+	return am.mimeType
 }
 
 // NewAudioMessage returns a ImageMessage ready to be encrypted
 func NewAudioMessage(sc *SessionContext, recipient string, filename string) (AudioMessage, error) {
-	recipientID := NewIDString(recipient)
+	audio, err := sc.Blobs.readFile(filename)
+	if err != nil {
+		return AudioMessage{}, fmt.Errorf("could not load audio: %s", err)
+	}
+	return NewAudioMessageFromBytes(sc, recipient, audio, "")
+}
+
+// NewAudioMessageFromReader returns an AudioMessage carrying the audio read from r. If mimeType is
+// empty, it is detected from the audio.
+func NewAudioMessageFromReader(sc *SessionContext, recipient string, r io.Reader, mimeType string) (AudioMessage, error) {
+	audio, err := sc.Blobs.readMedia(r)
+	if err != nil {
+		return AudioMessage{}, fmt.Errorf("could not read audio: %s", err)
+	}
+	return NewAudioMessageFromBytes(sc, recipient, audio, mimeType)
+}
+
+// NewAudioMessageFromBytes returns an AudioMessage carrying audio. If mimeType is empty, it is
+// detected from the audio.
+func NewAudioMessageFromBytes(sc *SessionContext, recipient string, audio []byte, mimeType string) (AudioMessage, error) {
+	recipientID, err := ParseIDString(recipient)
+	if err != nil {
+		return AudioMessage{}, err
+	}
 
 	im := AudioMessage{
 		messageHeader{
@@ -261,7 +341,7 @@ func NewAudioMessage(sc *SessionContext, recipient string, filename string) (Aud
 		},
 		audioMessageBody{},
 	}
-	err := im.SetAudioData(filename, *sc)
+	err = im.SetAudioBytes(audio, mimeType, sc)
 	if err != nil {
 		return AudioMessage{}, err
 	}
@@ -274,21 +354,42 @@ func (am AudioMessage) GetPrintableContent() string {
 }
 
 // GetAudioData return the decrypted audio, needs the recipients secret key
-func (am AudioMessage) GetAudioData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(am.BlobID, am.Key)
+func (am AudioMessage) GetAudioData(sc *SessionContext) ([]byte, error) {
+	return sc.cachedMedia(am.BlobID, secretboxSecret(am.Key), func() ([]byte, error) {
+		data, err := downloadAndDecryptSym(sc.Blobs, am.BlobID, am.Key)
+		if err == nil && sc.Blobs.AutoMarkDone {
+			// The audio is already decrypted, failing to clean up the server is not worth an error
+			sc.Blobs.MarkDone(am.BlobID)
+		}
+		return data, err
+	})
 }
 
 // SetAudioData encrypts and uploads the audio. Sets the blob info in the ImageMessage. Needs the recipients public key.
-func (am *AudioMessage) SetAudioData(filename string, sc SessionContext) error {
-	plainAudio, err := ioutil.ReadFile(filename)
+func (am *AudioMessage) SetAudioData(filename string, sc *SessionContext) error {
+	plainAudio, err := sc.Blobs.readFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not load audio: %s", err)
+	}
+	return am.SetAudioBytes(plainAudio, "", sc)
+}
+
+// SetAudioBytes encrypts and uploads audio like SetAudioData. If mimeType is empty, it is detected
+// from the audio. The duration is read from MP4/M4A, MP3, AAC and Ogg audio and set to
+// AudioDurationUnknown for other formats.
+func (am *AudioMessage) SetAudioBytes(plainAudio []byte, mimeType string, sc *SessionContext) error {
+	mimeType, err := mediaType(plainAudio, mimeType, audioTypes)
 	if err != nil {
-		return errors.New("could not load audio")
+		return err
 	}
+	am.mimeType = mimeType
 
-	// TODO: Should we have a whole media lib as dependency just to set this to the proper value?
-	am.Duration = 0xFF
+	am.Duration = AudioDurationUnknown
+	if d, err := audioDuration(plainAudio); err == nil {
+		am.Duration = audioDurationSeconds(d)
+	}
 
-	am.Key, am.ServerID, am.Size, am.BlobID, err = encryptAndUploadSym(plainAudio)
+	am.Key, am.ServerID, am.Size, am.BlobID, err = encryptAndUploadSym(sc, plainAudio)
 
 	return err
 }
@@ -314,10 +415,14 @@ type typingNotificationBody struct {
 
 // NewGroupTextMessages returns a slice of GroupMemberTextMessages ready to be encrypted
 func NewGroupTextMessages(sc *SessionContext, group Group, text string) ([]GroupTextMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
 	gtm := make([]GroupTextMessage, len(group.Members))
 	var tm TextMessage
 	var err error
 
+	fo := new(fanOut)
 	for i, member := range group.Members {
 		tm, err = NewTextMessage(sc, member.String(), text)
 		if err != nil {
@@ -327,7 +432,8 @@ func NewGroupTextMessages(sc *SessionContext, group Group, text string) ([]Group
 		gtm[i] = GroupTextMessage{
 			groupMessageHeader{
 				creatorID: group.CreatorID,
-				groupID:   group.GroupID},
+				groupID:   group.GroupID,
+				fanOut:    fo},
 			tm}
 	}
 
@@ -344,6 +450,33 @@ type GroupTextMessage struct {
 type groupMessageHeader struct {
 	creatorID IDString
 	groupID   [8]byte
+	fanOut    *fanOut // not serialized
+}
+
+// fanOut is shared by the copies of a message we send to the members of a group. Each copy has
+// an ID of its own, as the members expect.
+type fanOut struct {
+	mu       sync.Mutex
+	firstID  uint64
+	recorded bool
+}
+
+// record returns the ID of the copy recorded first, which is id on the first call. Received
+// messages have no fanOut and are always their own first copy.
+func (fo *fanOut) record(id uint64) uint64 {
+	if fo == nil {
+		return id
+	}
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	if !fo.recorded {
+		fo.firstID, fo.recorded = id, true
+	}
+	return fo.firstID
+}
+
+func (gmh groupMessageHeader) firstCopy(id uint64) uint64 {
+	return gmh.fanOut.record(id)
 }
 
 // Serialize : returns byte representation of serialized group text message
@@ -356,6 +489,13 @@ type groupImageMessageBody struct {
 	ServerID byte
 	Size     uint32
 	Key      [32]byte
+	mimeType string
+}
+
+// MediaType returns the MIME type of the image as checked when it was set. It is not transmitted,
+// so it is empty for received messages.
+func (im groupImageMessageBody) MediaType() string {
+	return im.mimeType
 }
 
 // GroupCreator returns the ID of the groups admin/creator as string
@@ -368,6 +508,47 @@ func (gmh groupMessageHeader) GroupID() [8]byte {
 	return gmh.groupID
 }
 
+// NewGroupImageMessages returns a slice of GroupImageMessages ready to be encrypted. The image is
+// uploaded once and shared by all messages.
+func NewGroupImageMessages(sc *SessionContext, group Group, filename string) ([]GroupImageMessage, error) {
+	image, err := sc.Blobs.readFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not load image: %s", err)
+	}
+	return NewGroupImageMessagesFromBytes(sc, group, image, "")
+}
+
+// NewGroupImageMessagesFromBytes returns a slice of GroupImageMessages carrying image. If mimeType
+// is empty, it is detected from the image.
+func NewGroupImageMessagesFromBytes(sc *SessionContext, group Group, image []byte, mimeType string) ([]GroupImageMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
+	var body groupImageMessageBody
+	if err := body.setImageBytes(image, mimeType, sc); err != nil {
+		return nil, err
+	}
+
+	gims := make([]GroupImageMessage, len(group.Members))
+	fo := new(fanOut)
+	for i, member := range group.Members {
+		gims[i] = GroupImageMessage{
+			groupMessageHeader{
+				creatorID: group.CreatorID,
+				groupID:   group.GroupID,
+				fanOut:    fo},
+			messageHeader{
+				sender:    sc.ID.ID,
+				recipient: member,
+				id:        NewMsgID(),
+				time:      time.Now(),
+				pubNick:   sc.ID.Nick},
+			body}
+	}
+
+	return gims, nil
+}
+
 //GroupImageMessage represents a group image message as sent e2e encrypted to other threema users
 type GroupImageMessage struct {
 	groupMessageHeader
@@ -381,35 +562,57 @@ func (im GroupImageMessage) Serialize() []byte {
 }
 
 // GetImageData return the decrypted Image needs the recipients secret key
-func (im GroupImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(im.BlobID, im.Key)
+func (im GroupImageMessage) GetImageData(sc *SessionContext) ([]byte, error) {
+	return sc.cachedMedia(im.BlobID, secretboxSecret(im.Key), func() ([]byte, error) {
+		return downloadAndDecryptSym(sc.Blobs, im.BlobID, im.Key)
+	})
+}
+
+// SetImageData encrypts the given image symmetrically, uploads it and adds it to the message
+func (im *GroupImageMessage) SetImageData(filename string, sc *SessionContext) error {
+	return im.groupImageMessageBody.setImageData(filename, sc)
 }
 
-// SetImageData encrypts the given image symmetrically and adds it to the message
-func (im *GroupImageMessage) SetImageData(filename string) error {
-	return im.groupImageMessageBody.setImageData(filename)
+// SetImageBytes encrypts and uploads image like SetImageData. If mimeType is empty, it is detected
+// from the image.
+func (im *GroupImageMessage) SetImageBytes(image []byte, mimeType string, sc *SessionContext) error {
+	return im.groupImageMessageBody.setImageBytes(image, mimeType, sc)
 }
 
-func (im *groupImageMessageBody) setImageData(filename string) error {
-	plainImage, err := ioutil.ReadFile(filename)
+func (im *groupImageMessageBody) setImageData(filename string, sc *SessionContext) error {
+	plainImage, err := sc.Blobs.readFile(filename)
 	if err != nil {
-		return errors.New("could not load image")
+		return fmt.Errorf("could not load image: %s", err)
 	}
+	return im.setImageBytes(plainImage, "", sc)
+}
+
+func (im *groupImageMessageBody) setImageBytes(plainImage []byte, mimeType string, sc *SessionContext) error {
+	plainImage, mimeType, err := sc.prepareImage(plainImage, mimeType)
+	if err != nil {
+		return err
+	}
+	im.mimeType = mimeType
 
-	im.Key, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadSym(plainImage)
+	im.Key, im.ServerID, im.Size, im.BlobID, err = encryptAndUploadSym(sc, plainImage)
 
 	return err
 }
 
 // NewGroupMemberLeftMessages returns a slice of GroupMemberLeftMessages ready to be encrypted
-func NewGroupMemberLeftMessages(sc *SessionContext, group Group) []GroupMemberLeftMessage {
+func NewGroupMemberLeftMessages(sc *SessionContext, group Group) ([]GroupMemberLeftMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
 	gml := make([]GroupMemberLeftMessage, len(group.Members))
 
+	fo := new(fanOut)
 	for i := 0; i < len(group.Members); i++ {
 		gml[i] = GroupMemberLeftMessage{
 			groupMessageHeader{
 				creatorID: group.CreatorID,
-				groupID:   group.GroupID},
+				groupID:   group.GroupID,
+				fanOut:    fo},
 			messageHeader{
 				sender:    sc.ID.ID,
 				recipient: group.Members[i],
@@ -419,7 +622,7 @@ func NewGroupMemberLeftMessages(sc *SessionContext, group Group) []GroupMemberLe
 
 	}
 
-	return gml
+	return gml, nil
 
 }
 
@@ -436,7 +639,10 @@ type GroupMemberLeftMessage struct {
 
 // NewDeliveryReceiptMessage returns a TextMessage ready to be encrypted
 func NewDeliveryReceiptMessage(sc *SessionContext, recipient string, msgID uint64, msgStatus MsgStatus) (DeliveryReceiptMessage, error) {
-	recipientID := NewIDString(recipient)
+	recipientID, err := ParseIDString(recipient)
+	if err != nil {
+		return DeliveryReceiptMessage{}, err
+	}
 
 	dm := DeliveryReceiptMessage{
 		messageHeader{
@@ -489,6 +695,11 @@ func (dm DeliveryReceiptMessage) MsgID() uint64 {
 // TODO: Implement message interface
 type groupManageMessageHeader struct {
 	groupID [8]byte
+	fanOut  *fanOut // not serialized
+}
+
+func (gmh groupManageMessageHeader) firstCopy(id uint64) uint64 {
+	return gmh.fanOut.record(id)
 }
 
 func (gmh groupManageMessageHeader) GroupID() [8]byte {
@@ -496,13 +707,18 @@ func (gmh groupManageMessageHeader) GroupID() [8]byte {
 }
 
 // NewGroupManageSetMembersMessages returns a slice of GroupManageSetMembersMessages ready to be encrypted
-func NewGroupManageSetMembersMessages(sc *SessionContext, group Group) []GroupManageSetMembersMessage {
+func NewGroupManageSetMembersMessages(sc *SessionContext, group Group) ([]GroupManageSetMembersMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
 	gms := make([]GroupManageSetMembersMessage, len(group.Members))
 
+	fo := new(fanOut)
 	for i := 0; i < len(group.Members); i++ {
 		gms[i] = GroupManageSetMembersMessage{
 			groupManageMessageHeader{
-				groupID: group.GroupID},
+				groupID: group.GroupID,
+				fanOut:  fo},
 			messageHeader{
 				sender:    sc.ID.ID,
 				recipient: group.Members[i],
@@ -514,7 +730,7 @@ func NewGroupManageSetMembersMessages(sc *SessionContext, group Group) []GroupMa
 
 	}
 
-	return gms
+	return gms, nil
 
 }
 
@@ -530,35 +746,61 @@ type GroupManageSetImageMessage struct {
 }
 
 // NewGroupManageSetImageMessages returns a slice of GroupManageSetImageMessages ready to be encrypted
-func NewGroupManageSetImageMessages(sc *SessionContext, group Group, filename string) []GroupManageSetImageMessage {
-	gms := make([]GroupManageSetImageMessage, len(group.Members))
+func NewGroupManageSetImageMessages(sc *SessionContext, group Group, filename string) ([]GroupManageSetImageMessage, error) {
+	image, err := sc.Blobs.readFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not load image: %s", err)
+	}
+	return NewGroupManageSetImageMessagesFromBytes(sc, group, image, "")
+}
+
+// NewGroupManageSetImageMessagesFromBytes returns a slice of GroupManageSetImageMessages setting
+// image as the group image. If mimeType is empty, it is detected from the image. The image is
+// uploaded once and shared by all messages.
+func NewGroupManageSetImageMessagesFromBytes(sc *SessionContext, group Group, image []byte, mimeType string) ([]GroupManageSetImageMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
+	var body groupImageMessageBody
+	if err := body.setImageBytes(image, mimeType, sc); err != nil {
+		return nil, err
+	}
 
+	gms := make([]GroupManageSetImageMessage, len(group.Members))
+	fo := new(fanOut)
 	for i := 0; i < len(group.Members); i++ {
 		gms[i] = GroupManageSetImageMessage{
 			groupManageMessageHeader{
-				groupID: group.GroupID},
-			messageHeader{}, //TODO:
-			groupImageMessageBody{},
-		}
-
-		err := gms[i].SetImageData(filename)
-		if err != nil {
-			//TODO: pretty sure this isn't a good idea
-			return nil
-		}
+				groupID: group.GroupID,
+				fanOut:  fo},
+			messageHeader{
+				sender:    sc.ID.ID,
+				recipient: group.Members[i],
+				id:        NewMsgID(),
+				time:      time.Now(),
+				pubNick:   sc.ID.Nick},
+			body}
 	}
 
-	return gms
+	return gms, nil
 }
 
 // GetImageData returns the decrypted Image
-func (im GroupManageSetImageMessage) GetImageData(sc SessionContext) ([]byte, error) {
-	return downloadAndDecryptSym(im.BlobID, im.Key)
+func (im GroupManageSetImageMessage) GetImageData(sc *SessionContext) ([]byte, error) {
+	return sc.cachedMedia(im.BlobID, secretboxSecret(im.Key), func() ([]byte, error) {
+		return downloadAndDecryptSym(sc.Blobs, im.BlobID, im.Key)
+	})
 }
 
-// SetImageData encrypts the given image symmetrically and adds it to the message
-func (im *GroupManageSetImageMessage) SetImageData(filename string) error {
-	return im.groupImageMessageBody.setImageData(filename)
+// SetImageData encrypts the given image symmetrically, uploads it and adds it to the message
+func (im *GroupManageSetImageMessage) SetImageData(filename string, sc *SessionContext) error {
+	return im.groupImageMessageBody.setImageData(filename, sc)
+}
+
+// SetImageBytes encrypts and uploads image like SetImageData. If mimeType is empty, it is detected
+// from the image.
+func (im *GroupManageSetImageMessage) SetImageBytes(image []byte, mimeType string, sc *SessionContext) error {
+	return im.groupImageMessageBody.setImageBytes(image, mimeType, sc)
 }
 
 //Serialize returns a fully serialized byte slice of an ImageMessage
@@ -584,13 +826,18 @@ func (gmm GroupManageSetMembersMessage) Serialize() []byte {
 }
 
 // NewGroupManageSetNameMessages returns a slice of GroupMenageSetNameMessages ready to be encrypted
-func NewGroupManageSetNameMessages(sc *SessionContext, group Group) []GroupManageSetNameMessage {
+func NewGroupManageSetNameMessages(sc *SessionContext, group Group) ([]GroupManageSetNameMessage, error) {
+	if err := group.Validate(); err != nil {
+		return nil, err
+	}
 	gms := make([]GroupManageSetNameMessage, len(group.Members))
 
+	fo := new(fanOut)
 	for i := 0; i < len(group.Members); i++ {
 		gms[i] = GroupManageSetNameMessage{
 			groupManageMessageHeader{
-				groupID: group.GroupID},
+				groupID: group.GroupID,
+				fanOut:  fo},
 			messageHeader{
 				sender:    sc.ID.ID,
 				recipient: group.Members[i],
@@ -602,7 +849,7 @@ func NewGroupManageSetNameMessages(sc *SessionContext, group Group) []GroupManag
 
 	}
 
-	return gms
+	return gms, nil
 
 }
 
@@ -94,6 +94,8 @@ func (sc *SessionContext) dispatchAckMsg(wr io.Writer, mp messagePacket) {
 		MsgID:    mp.ID}
 	serializedAckPkt := serializeAckPkt(ackP)
 
+	sc.sendMu.Lock()
+	defer sc.sendMu.Unlock()
 	sc.clientNonce.increaseCounter()
 	ackpCipherText := box.Seal(nil, serializedAckPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
 
@@ -109,6 +111,8 @@ func (sc *SessionContext) dispatchEchoMsg(wr io.Writer, oldEchoPacket echoPacket
 		Counter: oldEchoPacket.Counter + 1}
 	serializedEchoPkt := serializeEchoPkt(ep)
 
+	sc.sendMu.Lock()
+	defer sc.sendMu.Unlock()
 	sc.clientNonce.increaseCounter()
 	epCipherText := box.Seal(nil, serializedEchoPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
 
@@ -119,22 +123,20 @@ func (sc *SessionContext) dispatchEchoMsg(wr io.Writer, oldEchoPacket echoPacket
 	writeHelper(wr, buf)
 }
 
-func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) {
+// dispatchMessage encrypts and sends m. Messages to recipients whose key cannot be looked up or
+// has changed are not sent and the error is returned, a KeyChange as is.
+func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) error {
 	mh := m.header()
 
-	randNonce := newRandomNonce()
-
-	recipient, ok := sc.ID.Contacts.Get(mh.recipient.String())
-	if !ok {
-		var tr ThreemaRest
-		var err error
-
-		recipient, err = tr.GetContactByID(mh.recipient)
-		if err != nil {
-			panic("Recipient's PublicKey could not be found!")
+	recipient, err := sc.lookupContact(mh.recipient)
+	if err != nil {
+		if _, ok := err.(KeyChange); ok {
+			return err
 		}
-		sc.ID.Contacts.Add(recipient)
+		return fmt.Errorf("public key of %s could not be found: %s", mh.recipient, err)
 	}
+
+	randNonce := newRandomNonce()
 	msgCipherText := box.Seal(nil, m.Serialize(), randNonce.bytes(), &recipient.LPK, &sc.ID.LSK)
 
 	messagePkt := messagePacket{
@@ -151,6 +153,8 @@ func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) {
 
 	serializedMsgPkt := serializeMsgPkt(messagePkt)
 
+	sc.sendMu.Lock()
+	defer sc.sendMu.Unlock()
 	sc.clientNonce.increaseCounter()
 	serializedMsgPktCipherText := box.Seal(nil, serializedMsgPkt.Bytes(), sc.clientNonce.bytes(), &sc.serverSPK, &sc.clientSSK)
 
@@ -159,4 +163,5 @@ func (sc *SessionContext) dispatchMessage(wr io.Writer, m Message) {
 	binary.Write(buf, binary.LittleEndian, serializedMsgPktCipherText)
 
 	writeHelper(wr, buf)
+	return nil
 }
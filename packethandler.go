@@ -92,22 +92,22 @@ func (sc *SessionContext) handleClientServerMsg(buf *bytes.Buffer) interface{} {
 	case deliveringMsg:
 		// It is an e2e message!
 		msgPkt := parseMsgPkt(bytes.NewBuffer(plaintext))
+		if c, ok := sc.ID.Contacts.Get(msgPkt.Sender.String()); ok && c.Blocked {
+			return blockedMsgPacket{messagePacket: msgPkt}
+		}
 		// Find the sender in our contacts, because we need their public key
-		sender, ok := sc.ID.Contacts.Get(msgPkt.Sender.String())
-		if !ok {
-			var tr ThreemaRest
-			var err error
-			// TODO: Add to local contacts?
-			sender, err = tr.GetContactByID(msgPkt.Sender)
-			if err != nil {
-				panic("Sender's PublicKey could not be found!")
-			}
-			sc.ID.Contacts.Add(sender)
+		sender, err := sc.lookupContact(msgPkt.Sender)
+		if err != nil {
+			return refuseMsg(msgPkt, err)
 		}
 		// Decrypt using our private and their public key
 		msgPkt.Plaintext, ok = box.Open(nil, msgPkt.Ciphertext, msgPkt.Nonce.bytes(), &sender.LPK, &sc.ID.LSK)
 		if !ok {
-			panic("Cannot decrypt e2e MSG!")
+			// The sender might have a new key. Check with the server so a key change gets surfaced.
+			if _, err := sc.RefreshContact(msgPkt.Sender.String()); err != nil {
+				return refuseMsg(msgPkt, err)
+			}
+			return refusedMsgPacket{messagePacket: msgPkt, err: UndecryptableMessage{Sender: msgPkt.Sender, ID: msgPkt.ID}}
 		}
 
 		return msgPkt
@@ -128,14 +128,36 @@ func (sc *SessionContext) handleClientServerMsg(buf *bytes.Buffer) interface{} {
 	}
 }
 
+// refuseMsg wraps a failed lookup of the sender's key of mp. Only a KeyChange is final, other
+// failures may go away, so the message is left with the server to be delivered again.
+func refuseMsg(mp messagePacket, err error) refusedMsgPacket {
+	if kc, ok := err.(KeyChange); ok {
+		return refusedMsgPacket{messagePacket: mp, err: kc}
+	}
+	return refusedMsgPacket{
+		messagePacket: mp,
+		err:           fmt.Errorf("public key of %s could not be found: %s", mp.Sender, err),
+		retry:         true}
+}
+
 //handleMessagePacket parses a messagePacket and returns the according Message type (ImageMessage, TextMessage etc.)
 func (sc *SessionContext) handleMessagePacket(mp messagePacket) (Message, error) {
+	return decodeMessage(mp)
+}
+
+//decodeMessage parses the decrypted plaintext of a messagePacket into the according Message type. It is
+//shared by the chat protocol and the gateway callback.
+func decodeMessage(mp messagePacket) (message Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			message, err = nil, handlerPanicHandler("decodeMessage", r)
+		}
+	}()
 	// DEBUG
 	//fmt.Print(hex.Dump(mp.Plaintext))
 
 	buf := bytes.NewBuffer(mp.Plaintext)
 
-	var message Message
 	mt := parseMessageType(buf)
 	switch mt {
 	case TEXTMESSAGE:
@@ -233,6 +233,9 @@ func parseAudioMessage(buf *bytes.Buffer) audioMessageBody {
 		Size:     parseUint32(buf),
 		Key:      parseKey(buf)}
 	am.ServerID = am.BlobID[0]
+	if !plausibleAudioDuration(am.Duration, am.Size) {
+		am.Duration = AudioDurationUnknown
+	}
 	return am
 }
 
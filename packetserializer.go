@@ -59,8 +59,7 @@ func serializeAudioMsg(am AudioMessage) *bytes.Buffer {
 
 	buf := new(bytes.Buffer)
 	serializeMsgType(buf, AUDIOMESSAGE)
-	// AudioClip duration
-	serializeUint16(buf, 0xFFFF)
+	serializeUint16(buf, am.Duration)
 	serializeBlobID(buf, am.BlobID)
 	serializeUint32(buf, am.Size)
 	serializeKey(buf, am.Key)
@@ -266,13 +265,13 @@ func contextualSerializeHelper(context string, buf *bytes.Buffer, i interface{})
 	return buf
 }
 
-// serializePadding returns a byte slice filled with n repetitions of the byte value n
+// serializePadding returns a byte slice filled with n repetitions of the byte value n, 1 <= n <= 255
 func serializePadding(buf *bytes.Buffer) {
 	paddingValueBig, err := rand.Int(rand.Reader, big.NewInt(255))
 	if err != nil {
 		panic(err)
 	}
-	paddingValue := byte(paddingValueBig.Int64())
+	paddingValue := byte(paddingValueBig.Int64() + 1)
 	padding := make([]byte, paddingValue)
 	for i := range padding {
 		padding[i] = paddingValue
@@ -37,6 +37,19 @@ type messagePacket struct {
 	Plaintext  []byte
 }
 
+// refusedMsgPacket is a message packet that could not be decrypted, because the sender's key
+// changed or could not be looked up or the ciphertext is invalid
+type refusedMsgPacket struct {
+	messagePacket
+	err   error
+	retry bool // the lookup of the sender's key failed, the message should be delivered again
+}
+
+// blockedMsgPacket is a message packet from a blocked contact. It is not decrypted.
+type blockedMsgPacket struct {
+	messagePacket
+}
+
 type ackPacket struct {
 	PktType  pktType
 	SenderID IDString
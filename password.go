@@ -0,0 +1,88 @@
+package o3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+)
+
+// PasswordProvider supplies the password used to decrypt an identity backup. Besides reading it
+// from the terminal it can be taken from the environment, a file descriptor, a file or a callback
+// so daemons can load their identity without user interaction.
+type PasswordProvider interface {
+	Password() ([]byte, error)
+}
+
+// PasswordFunc adapts an ordinary function to the PasswordProvider interface
+type PasswordFunc func() ([]byte, error)
+
+// Password calls f
+func (f PasswordFunc) Password() ([]byte, error) {
+	return f()
+}
+
+// TerminalPassword prompts for the password on the command line using ReadPassword
+var TerminalPassword PasswordProvider = PasswordFunc(ReadPassword)
+
+// EnvPassword returns a PasswordProvider reading the password from the environment variable name
+func EnvPassword(name string) PasswordProvider {
+	return PasswordFunc(func() ([]byte, error) {
+		pw, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(pw), nil
+	})
+}
+
+// FDPassword returns a PasswordProvider reading the password from the already opened file
+// descriptor fd until EOF, e.g. a pipe set up by the parent process. The provider takes ownership
+// of fd and closes it afterwards, so it can only be used once. A trailing newline is removed.
+func FDPassword(fd uintptr) PasswordProvider {
+	return PasswordFunc(func() ([]byte, error) {
+		f := os.NewFile(fd, fmt.Sprintf("fd%d", fd))
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor: %d", fd)
+		}
+		defer f.Close()
+
+		buf, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return trimNewline(buf), nil
+	})
+}
+
+// FilePassword returns a PasswordProvider reading the password from the file with the given name.
+// The file must not be accessible by group or others. A trailing newline is removed.
+func FilePassword(filename string) PasswordProvider {
+	return PasswordFunc(func() ([]byte, error) {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		// Windows does not report meaningful permission bits
+		if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("password file %s is accessible by others (mode %v)", filename, fi.Mode().Perm())
+		}
+
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return trimNewline(buf), nil
+	})
+}
+
+// errEmptyPassword is returned when a provider yields an empty password
+var errEmptyPassword = errors.New("empty password")
+
+// trimNewline removes a single trailing "\n" or "\r\n" from buf
+func trimNewline(buf []byte) []byte {
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	return bytes.TrimSuffix(buf, []byte("\r"))
+}
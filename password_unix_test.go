@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package o3
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFDPassword(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.Write([]byte("secret\n"))
+		w.Close()
+	}()
+
+	// FDPassword closes the descriptor it is given, so hand it a duplicate
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := FDPassword(uintptr(fd)).Password()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pw, []byte("secret")) {
+		t.Errorf("read password %q", pw)
+	}
+}
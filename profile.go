@@ -0,0 +1,116 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Profile bundles the complete state of a client: the ThreemaID including its Contacts, Groups
+// and nickname, plus application defined settings. It is stored in a single password-encrypted
+// file so a bot can be restarted without losing anything.
+type Profile struct {
+	ID       ThreemaID
+	Settings map[string]string
+}
+
+// NewProfile returns a Profile for the given ID with empty settings
+func NewProfile(thid ThreemaID) *Profile {
+	return &Profile{
+		ID:       thid,
+		Settings: make(map[string]string)}
+}
+
+// profileMagic starts every profile file. The last two bytes are the format version.
+var profileMagic = []byte("o3prof01")
+
+type profileFile struct {
+	Identity  string            `json:"identity"`
+	SecretKey string            `json:"secretKey"`
+	Nickname  string            `json:"nickname,omitempty"`
+	Contacts  *AddressBook      `json:"contacts"`
+	Groups    *GroupBook        `json:"groups"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+// SaveTo encrypts the Profile with password and atomically writes it to the file with the
+// given name. The key is derived from the password using PBKDF2 like in Threema's ID export,
+// the content is sealed using XSalsa20 and Poly1305.
+func (p *Profile) SaveTo(filename string, password []byte) error {
+	pf := profileFile{
+		Identity:  p.ID.String(),
+		SecretKey: hex.EncodeToString(p.ID.LSK[:]),
+		Nickname:  strings.TrimRight(p.ID.Nick.String(), "\x00"),
+		Contacts:  &p.ID.Contacts,
+		Groups:    &p.ID.Groups,
+		Settings:  p.Settings}
+	plain, err := json.Marshal(pf)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key := genkey(password, salt)
+	n := newRandomNonce()
+
+	buf := append([]byte{}, profileMagic...)
+	buf = append(buf, salt...)
+	buf = append(buf, n.byteSlice()...)
+	buf = secretbox.Seal(buf, plain, n.bytes(), &key)
+
+	return writeFileAtomic(filename, buf, 0600)
+}
+
+// LoadProfile reads and decrypts a Profile written by SaveTo
+func LoadProfile(filename string, password []byte) (*Profile, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < len(profileMagic)+8+24+secretbox.Overhead || !bytes.Equal(buf[:len(profileMagic)], profileMagic) {
+		return nil, errors.New("file does not contain a valid profile")
+	}
+	buf = buf[len(profileMagic):]
+
+	key := genkey(password, buf[0:8])
+	var n nonce
+	n.set(buf[8:32])
+	plain, ok := secretbox.Open(nil, buf[32:], n.bytes(), &key)
+	if !ok {
+		return nil, errors.New("Verification failed. Wrong password?")
+	}
+
+	thid := ThreemaID{
+		Contacts: NewAddressBook(),
+		Groups:   NewGroupBook()}
+	pf := profileFile{
+		Contacts: &thid.Contacts,
+		Groups:   &thid.Groups}
+	if err := json.Unmarshal(plain, &pf); err != nil {
+		return nil, err
+	}
+	id, err := ParseIDString(pf.Identity)
+	if err != nil {
+		return nil, err
+	}
+	thid.ID = id
+	thid.Nick = NewPubNick(pf.Nickname)
+	if err := decodeKey(pf.SecretKey, &thid.LSK); err != nil {
+		return nil, err
+	}
+
+	p := NewProfile(thid)
+	for k, v := range pf.Settings {
+		p.Settings[k] = v
+	}
+	return p, nil
+}
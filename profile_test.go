@@ -0,0 +1,60 @@
+package o3
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfileRoundTrip(t *testing.T) {
+	tid, err := NewThreemaID("TESTSELF", [32]byte{1, 2, 3}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Nick = NewPubNick("Bot")
+	if err := tid.Contacts.ImportFrom("test/idAlice.ab"); err != nil {
+		t.Fatal(err)
+	}
+	group := Group{
+		CreatorID: tid.ID,
+		GroupID:   [8]byte{8, 7, 6, 5, 4, 3, 2, 1},
+		Name:      "Ops",
+		Members:   []IDString{NewIDString("FUA2U3N8"), tid.ID}}
+	tid.Groups.Add(group)
+
+	p := NewProfile(tid)
+	p.Settings["greeting"] = "hello"
+
+	filename := filepath.Join(t.TempDir(), "bot.profile")
+	if err := p.SaveTo(filename, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadProfile(filename, []byte("wrong")); err == nil {
+		t.Error("profile was decrypted using a wrong password")
+	}
+
+	loaded, err := LoadProfile(filename, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID.ID != tid.ID || loaded.ID.LSK != tid.LSK || loaded.ID.Nick != tid.Nick {
+		t.Errorf("identity did not round-trip: %s", loaded.ID)
+	}
+	if !reflect.DeepEqual(loaded.Settings, p.Settings) {
+		t.Errorf("settings did not round-trip: %v", loaded.Settings)
+	}
+	if got, ok := loaded.ID.Groups.Get(group.CreatorID, group.GroupID); !ok || !reflect.DeepEqual(got, group) {
+		t.Errorf("group did not round-trip: %#v", got)
+	}
+	want := tid.Contacts.Contacts()
+	got := loaded.ID.Contacts.Contacts()
+	if len(got) != len(want) {
+		t.Fatalf("%d contacts saved, %d loaded", len(want), len(got))
+	}
+	for id, c := range want {
+		if got[id].LPK != c.LPK {
+			t.Errorf("contact %s did not round-trip", id)
+		}
+	}
+}
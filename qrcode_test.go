@@ -0,0 +1,155 @@
+package o3
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestWriteQRCode(t *testing.T) {
+	payload := "3mid:ECHOECHO," + string(bytes.Repeat([]byte("ab"), 32))
+
+	var buf bytes.Buffer
+	if err := WriteQRCode(&buf, payload, 2); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 78 bytes need version 5 (37 modules) at level M, plus a quiet zone of 4 modules on each side
+	if dim := img.Bounds().Dx(); dim != (37+8)*2 {
+		t.Fatalf("unexpected image size: %d", dim)
+	}
+	// the top left finder pattern has a dark outer ring and a light inner ring
+	if r, _, _, _ := img.At(8, 8).RGBA(); r != 0 {
+		t.Error("finder pattern corner is not dark")
+	}
+	if r, _, _, _ := img.At(10, 10).RGBA(); r == 0 {
+		t.Error("finder pattern inner ring is not light")
+	}
+}
+
+// TestEncodeQR compares the module matrices of fixed payloads and masks, '#' being dark, with
+// those produced by an independent encoder
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		payload string
+		mask    int
+		modules []string
+	}{
+		{"3mid:ECHOECHO," + strings.Repeat("ab", 32), 3, []string{
+			"#######.###.#.#...####.#....#.#######",
+			"#.....#.#.#######...#..####...#.....#",
+			"#.###.#...#.###.#........#.##.#.###.#",
+			"#.###.#.###...####....#.####..#.###.#",
+			"#.###.#....##...##.#....#.###.#.###.#",
+			"#.....#..#.##.##...####..#....#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#.#.#######",
+			"........######.#.##.#................",
+			"#.##.###.#...#.#.###.#....#.#.#..#.##",
+			"#.#.##....####.#..####.#....#..#.#...",
+			"##.#..#.#.#.##..##...#.#..#.#.####...",
+			"....##..##.###..#.##..##.##.####.###.",
+			"##..####..#.##.#.#....#.####.##..###.",
+			"##.###.##.....####.#....#.####.##.###",
+			"....###.#....##..#.#..#.#...#..#.###.",
+			"####.#.####....#..##.##.#..##...#....",
+			"#.#...##...#.#...#..####.#.#......##.",
+			"...#.#.#.#.#........#.####.#..#...#.#",
+			"###..###.#...##..##..#...#.#.##.#####",
+			"##.....#..#...####.##.##..##....##..#",
+			".#.#..#.###.########.#....#.##.#.....",
+			".........#..##..######.#......##.....",
+			"..##..#...#.......#..#.#..#.##.#.....",
+			"#...##.##.##...###.#..##.###.#.#..##.",
+			".#.#..#.##....###.....#.###..##.#.#.#",
+			".#........####...#.#....#.#######...#",
+			".#..###...#..##....####..#.......##..",
+			"#...##..#.######.....#.##.##.#.......",
+			"....#.#.#....##...#.####.#..#####.#.#",
+			"........###.#..#....#.####..#...#...#",
+			"#######.#....####.#..#...#.##.#.#####",
+			"#.....#.##...#...####.##..###...##.##",
+			"#.###.#...#..##.#..#.#....#.#####.#..",
+			"#.###.#.#.##.#.##..###.#...#.##..#..#",
+			"#.###.#.###.#.##....#..####.##.##.#..",
+			"#.....#...#.#.##.........#.......##..",
+			"#######.#####.#..#....#.###....#.####",
+		}},
+		// version 7 is the first to carry version information
+		{"3mid:ECHOECHO," + strings.Repeat("0123456789abcdef", 6), 6, []string{
+			"#######.#.########..##.#.###.####...#.#######",
+			"#.....#.##.####.#.#....##....#.....#..#.....#",
+			"#.###.#.#.#.#.#....#.#####...#####.#..#.###.#",
+			"#.###.#..##...##.##..#...##.#####..##.#.###.#",
+			"#.###.#.##.#.#.#.#.######.#.#.#...###.#.###.#",
+			"#.....#...##........#...##..##...#....#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+			"...........##.#....##...#.######.####........",
+			"#..#######..##.#.#.######..##.#....#.#..#.###",
+			"....#...#...#...#.#######.#.####.##.###...#..",
+			"#..#..#.#.##.#....###.####...#..##....###.###",
+			".##.#..##..#####..#...#.##..###.#...##.#.####",
+			".#..###.#.#####.#.#.#..####.....#.#...###..##",
+			".#.......###.#.....#####.##.######..###.#.##.",
+			"#.....#....#....######..#.#......#..#.###.#..",
+			"###....#....#.#...####....##..#......###..###",
+			"....###..###...##.####..##.#.##.##.##.##...##",
+			"..##.....#..##.###....#....######.#.#..#..###",
+			"#...#####.#..###.###..###..##......##..###.##",
+			"###..#.#.#####..##..##.#...#####.#...####.##.",
+			"##.######...###..############......#######...",
+			".#..#...####....#..##...##....###.###...##.#.",
+			"...##.#.#..####.###.#.#.#.##....#.###.#.#.#.#",
+			"#.###...#.#.....#.#.#...##.#..#.#####...#.#..",
+			".#..#####...##.###########.##.#.#.#.######.##",
+			"...#.#...###..#.###...##########.#........#..",
+			"####..####.#####.#.###.#..###..#.##..#.##..#.",
+			"..###..###....#....####.###.###...####.##.#..",
+			"..#..####.##.#...#..#..#####.####..####.#..#.",
+			"#......##.######.#..#..#......#####..#..###.#",
+			"##.#####.####.####..##.##...##.###.#..###.#.#",
+			"####.....#####.####....#..###.###.######..###",
+			"#...#.#..##..#....#..##..#.####...#......#...",
+			"..#.....#.####.##..#.#.#..#.#.#.####....#.#..",
+			"....#.#.##..###.#.#..#...#.#.....####.#..####",
+			".####..#.####..#.##..####..#.##.#..#.##.####.",
+			"#..##.#####...#..##.#####.#####.#########...#",
+			"........##...####.###...####..#.#..##...#....",
+			"#######.#......#..#.#.#.#..###.##..##.#.####.",
+			"#.....#.#..#.###...##...####.##...#.#...###..",
+			"#.###.#.###.#.###...######.#.#.##.########.##",
+			"#.###.#.#.##..#.####..#.#....###.##..#.#.##.#",
+			"#.###.#...#.#..######.#.#..##..######.###...#",
+			"#.....#....#.#.....#...#..#.####....###.#.###",
+			"#######.#.#.####.....#..###.###..#.##.####...",
+		}},
+	}
+	for _, tt := range tests {
+		qr, err := newQRCode([]byte(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		qr.applyMask(tt.mask)
+		qr.drawFormatBits(tt.mask)
+		if qr.size != len(tt.modules) {
+			t.Errorf("%d byte payload encoded with %d modules, want %d", len(tt.payload), qr.size, len(tt.modules))
+			continue
+		}
+		for y, want := range tt.modules {
+			got := make([]byte, qr.size)
+			for x := range got {
+				got[x] = '.'
+				if qr.modules[y][x] {
+					got[x] = '#'
+				}
+			}
+			if string(got) != want {
+				t.Errorf("%d byte payload, row %d:\ngot  %s\nwant %s", len(tt.payload), y, got, want)
+			}
+		}
+	}
+}
@@ -1,148 +1,421 @@
 package o3
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 
-	"errors"
-
-	"github.com/o3ma/o3rest/apiclient_pkg"
-	"github.com/o3ma/o3rest/models_pkg"
 	"golang.org/x/crypto/nacl/box"
 )
 
-// ThreemaRest provides convenient wrappers for task that require the use of Threemas REST API
+// ThreemaRest provides convenient wrappers for task that require the use of Threemas REST API.
+// The zero value talks to the production servers.
 type ThreemaRest struct {
-	client apiclient_pkg.APICLIENT_IMPL
+	// BaseURL is the base URL of the directory API. If empty, DefaultAPIURL is used.
+	BaseURL string
+	// Client is used for all requests. If nil, a client trusting the Threema CA is used.
+	Client *http.Client
+	// UserAgent is sent with every request. If empty, DefaultUserAgent is used.
+	UserAgent string
+	ctx       context.Context
 }
 
-// CreateIdentity generates a new NaCl Keypair, registers it with the Three servers and returns the assigned ID
-func (tr ThreemaRest) CreateIdentity() (ThreemaID, error) {
-	// Get Keypair and nonce ready
-	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		return ThreemaID{}, err
+// DefaultAPIURL is the base URL of Threema's directory API
+const DefaultAPIURL = "https://api.threema.ch/"
+
+// DefaultUserAgent is the user agent sent to Threema's servers
+const DefaultUserAgent = "Threema/2.8"
+
+// NewThreemaRest returns a ThreemaRest for the API at baseURL using client for all requests
+func NewThreemaRest(baseURL string, client *http.Client) ThreemaRest {
+	return ThreemaRest{
+		BaseURL:   baseURL,
+		Client:    client,
+		UserAgent: DefaultUserAgent}
+}
+
+// WithContext returns a copy of tr whose requests are bound to ctx
+func (tr ThreemaRest) WithContext(ctx context.Context) ThreemaRest {
+	tr.ctx = ctx
+	return tr
+}
+
+// Context returns the context requests are bound to, context.Background() if none was set
+func (tr ThreemaRest) Context() context.Context {
+	if tr.ctx == nil {
+		return context.Background()
 	}
+	return tr.ctx
+}
 
-	pubkey := base64.StdEncoding.EncodeToString(publicKey[:])
+// challengeNonce is the nonce used to answer token challenges. It is hardcoded in threema.
+var challengeNonce = [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
 
-	// The nonce is hardcoded in threema
-	nonce := [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
+// newThreemaClient returns a http.Client trusting the Threema CA
+func newThreemaClient() *http.Client {
+	CAPool := x509.NewCertPool()
+	CAPool.AppendCertsFromPEM(threemaCert)
 
-	// Request token and tokenRespKeyPub
-	idCreateParams := models_pkg.CreateRequest{
-		PublicKey: &pubkey}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: CAPool}}}
+}
 
-	challenge, err := tr.client.IdentityCreate(&idCreateParams)
-	if err != nil {
-		return ThreemaID{}, err
+// threemaClient is shared by all ThreemaRest values without a Client
+var threemaClient = newThreemaClient()
+
+// do sends req with the configured user agent and context using the configured client
+func (tr ThreemaRest) do(req *http.Request) (*http.Response, error) {
+	userAgent := tr.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	client := tr.Client
+	if client == nil {
+		client = threemaClient
+	}
+	return client.Do(req.WithContext(tr.Context()))
+}
+
+// decodeResponse checks the status of resp and decodes its JSON body into v
+func decodeResponse(path string, resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
 	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	// Decode token and tokenRespPub
-	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(*challenge.TokenRespKeyPub)
+// getJSON requests the API endpoint path and decodes the response into resp
+func (tr ThreemaRest) getJSON(path string, resp interface{}) error {
+	httpReq, err := http.NewRequest("GET", tr.url(path), nil)
 	if err != nil {
-		return ThreemaID{}, err
+		return err
 	}
-	var tokenPubKey [32]byte
-	copy(tokenPubKey[:], tokenRespKeyPub[:32])
+	httpResp, err := tr.do(httpReq)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(path, httpResp, resp)
+}
 
-	token, err := base64.StdEncoding.DecodeString(*challenge.Token)
+func (tr ThreemaRest) url(path string) string {
+	base := tr.BaseURL
+	if base == "" {
+		base = DefaultAPIURL
+	}
+	return strings.TrimRight(base, "/") + "/" + path
+}
+
+// postJSON sends req JSON-encoded to the API endpoint path and decodes the response into resp
+func (tr ThreemaRest) postJSON(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
 	if err != nil {
-		return ThreemaID{}, err
+		return err
 	}
+	httpReq, err := http.NewRequest("POST", tr.url(path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
 
-	// Compute the Response
-	tokenResponse := base64.StdEncoding.EncodeToString(box.Seal(nil, []byte(token), &nonce, &tokenPubKey, privateKey))
+	httpResp, err := tr.do(httpReq)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(path, httpResp, resp)
+}
 
-	response := models_pkg.CreateStage2Request{
-		PublicKey: &pubkey,
-		Response:  &tokenResponse,
-		Token:     challenge.Token}
+// apiChallenge is the first stage response of API calls that require proof of the private key
+type apiChallenge struct {
+	Token           string `json:"token"`
+	TokenRespKeyPub string `json:"tokenRespKeyPub"`
+}
 
-	finalResult, err := tr.client.IdentityCreateStage2(&response)
+// solve answers the challenge using the private key lsk and returns the base64 encoded response
+func (c apiChallenge) solve(lsk *[32]byte) (string, error) {
+	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(c.TokenRespKeyPub)
 	if err != nil {
-		return ThreemaID{}, err
+		return "", err
 	}
-	if !*finalResult.Success {
-		panic("Server responded with error!")
+	if len(tokenRespKeyPub) != 32 {
+		return "", fmt.Errorf("invalid challenge key length: %d", len(tokenRespKeyPub))
 	}
+	var tokenPubKey [32]byte
+	copy(tokenPubKey[:], tokenRespKeyPub)
 
-	newID := ThreemaID{
-		ID:   NewIDString(*finalResult.Identity),
-		Nick: NewPubNick(*finalResult.Identity),
-		LSK:  *privateKey}
-
-	if !tr.setFeatureLevel(newID, 1) {
-		return ThreemaID{}, errors.New("failed to set feature level")
+	token, err := base64.StdEncoding.DecodeString(c.Token)
+	if err != nil {
+		return "", err
 	}
+	return base64.StdEncoding.EncodeToString(box.Seal(nil, token, &challengeNonce, &tokenPubKey, lsk)), nil
+}
 
-	return newID, nil
+// apiResult is the final response of API calls that can fail
+type apiResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
 
+func (r apiResult) err(context string) error {
+	if r.Success {
+		return nil
+	}
+	if r.Error == "" {
+		return fmt.Errorf("%s failed", context)
+	}
+	return fmt.Errorf("%s failed: %s", context, r.Error)
 }
 
-// setFeatureLevel lets the threema servers know which features are supported by the client/id
-// 0 = {Text, Pictures, Videos}, 1 = {0, Audio, Groups}, 2 = {1, Ballots}, 3 = {2, Files}
-func (tr ThreemaRest) setFeatureLevel(thid ThreemaID, featurelevel int) (succes bool) {
-	featureLevelFloat := float64(featurelevel)
+// requestChallenge posts request to the API endpoint path and returns the challenge the server
+// answers with. The remaining fields of the response are decoded into extra if not nil, even if the
+// response carries no challenge, as the server omits it when there is nothing left to do.
+func (tr ThreemaRest) requestChallenge(path string, request, extra interface{}) (apiChallenge, error) {
+	var raw json.RawMessage
+	if err := tr.postJSON(path, request, &raw); err != nil {
+		return apiChallenge{}, err
+	}
 
-	// The nonce is hardcoded in threema
-	nonce := [24]byte{0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x20, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e}
-	nonceB64 := base64.StdEncoding.EncodeToString(nonce[:])
+	if extra != nil {
+		if err := json.Unmarshal(raw, extra); err != nil {
+			return apiChallenge{}, err
+		}
+	}
+	var challenge apiChallenge
+	if err := json.Unmarshal(raw, &challenge); err != nil {
+		return apiChallenge{}, err
+	}
+	if challenge.Token == "" || challenge.TokenRespKeyPub == "" {
+		var result apiResult
+		json.Unmarshal(raw, &result)
+		if result.Error == "" {
+			return apiChallenge{}, fmt.Errorf("request to %s failed: no challenge in response", path)
+		}
+		return apiChallenge{}, result.err("request to " + path)
+	}
+	return challenge, nil
+}
 
-	idString := thid.String()
-	request := models_pkg.SetFeaturelevelRequest{
-		Identity:     &idString,
-		FeatureLevel: &featureLevelFloat}
+// answerChallenge solves challenge using the private key lsk and posts the response together with
+// the fields of request to the API endpoint path. The final response is decoded into resp if not
+// nil. An error is returned unless the server reports success.
+func (tr ThreemaRest) answerChallenge(path string, request interface{}, challenge apiChallenge, lsk *[32]byte, resp interface{}) error {
+	response, err := challenge.solve(lsk)
+	if err != nil {
+		return err
+	}
 
-	challenge, err := tr.client.IdentitySetFeaturelevel(&request)
+	// Resend the fields of the first stage as they were encoded, along with token and response
+	fields := make(map[string]json.RawMessage)
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return fmt.Errorf("request to %s is not a JSON object: %s", path, err)
+	}
+	fields["token"], _ = json.Marshal(challenge.Token)
+	fields["response"], _ = json.Marshal(response)
+
+	var raw json.RawMessage
+	if err := tr.postJSON(path, fields, &raw); err != nil {
+		return err
+	}
+	var result apiResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return err
+	}
+	if err := result.err("request to " + path); err != nil {
+		return err
+	}
+	if resp != nil {
+		return json.Unmarshal(raw, resp)
+	}
+	return nil
+}
 
-	// Decode token and tokenRespPub
-	tokenRespKeyPub, err := base64.StdEncoding.DecodeString(*challenge.TokenRespKeyPub)
+// signedRequest performs an API call that requires proof of the private key lsk: request is posted
+// to the endpoint path, the challenge returned is solved and posted back along with request. The
+// final response is decoded into resp if not nil.
+func (tr ThreemaRest) signedRequest(path string, request interface{}, lsk *[32]byte, resp interface{}) error {
+	challenge, err := tr.requestChallenge(path, request, nil)
 	if err != nil {
-		return false
+		return err
 	}
-	var tokenPubKey [32]byte
-	copy(tokenPubKey[:], tokenRespKeyPub[:32])
+	return tr.answerChallenge(path, request, challenge, lsk, resp)
+}
 
-	token, err := base64.StdEncoding.DecodeString(*challenge.Token)
+// CreateIdentity generates a new NaCl Keypair, registers it with the Three servers and returns the assigned ID
+func (tr ThreemaRest) CreateIdentity() (ThreemaID, error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
 	if err != nil {
-		return false
+		return ThreemaID{}, err
 	}
 
-	// Compute the Response
-	tokenResponse := base64.StdEncoding.EncodeToString(box.Seal(nil, []byte(token), &nonce, &tokenPubKey, &thid.LSK))
+	request := struct {
+		PublicKey string `json:"publicKey"`
+	}{base64.StdEncoding.EncodeToString(publicKey[:])}
 
-	response := models_pkg.SetFeaturelevelStage2Request{
-		Response:     &tokenResponse,
-		Identity:     &idString,
-		Nonce:        &nonceB64,
-		Token:        challenge.Token,
-		FeatureLevel: &featureLevelFloat,
+	var result struct {
+		Identity string `json:"identity"`
 	}
-
-	result, err := tr.client.IdentitySetFeaturelevelStage2(&response)
+	if err := tr.signedRequest("identity/create", request, privateKey, &result); err != nil {
+		return ThreemaID{}, err
+	}
+	id, err := ParseIDString(result.Identity)
 	if err != nil {
-		return false
+		return ThreemaID{}, fmt.Errorf("server assigned invalid ID: %s", err)
+	}
+
+	newID := ThreemaID{
+		ID:       id,
+		Nick:     NewPubNick(result.Identity),
+		LSK:      *privateKey,
+		Contacts: NewAddressBook(),
+		Groups:   NewGroupBook()}
+
+	if err := tr.SetFeatureMask(newID, DefaultFeatureMask); err != nil {
+		return ThreemaID{}, err
 	}
 
-	return *result.Success
+	return newID, nil
 }
 
 // GetContactByID returns a ThreemaContact containing the public key as queried from the Threema servers
 func (tr ThreemaRest) GetContactByID(thIDString IDString) (ThreemaContact, error) {
-	response, err := tr.client.IdentityById(thIDString.String())
+	var entry directoryEntry
+	if err := tr.getJSON("identity/"+thIDString.String(), &entry); err != nil {
+		return ThreemaContact{}, err
+	}
+	contact, err := entry.contact()
 	if err != nil {
 		return ThreemaContact{}, err
 	}
+	if contact.ID != thIDString {
+		return ThreemaContact{}, fmt.Errorf("requested %s, server returned %s", thIDString, contact.ID)
+	}
+	return contact, nil
+}
+
+// emailHashKey and phoneHashKey are the HMAC keys Threema uses to hash email addresses and phone
+// numbers for directory lookups
+var (
+	emailHashKey = []byte{0x30, 0xa5, 0x50, 0x0f, 0xed, 0x97, 0x01, 0xfa, 0x6d, 0xef, 0xdb, 0x61, 0x08, 0x41, 0x90, 0x0f, 0xeb, 0xb8, 0xe4, 0x30, 0x88, 0x1f, 0x7a, 0xd8, 0x16, 0x82, 0x62, 0x64, 0xec, 0x09, 0xba, 0xd7}
+	phoneHashKey = []byte{0x85, 0xad, 0xf8, 0x22, 0x69, 0x53, 0xf3, 0xd9, 0x6c, 0xfd, 0x5d, 0x09, 0xbf, 0x29, 0x55, 0x5e, 0xb9, 0x55, 0xfc, 0xd8, 0xaa, 0x5e, 0xc4, 0xf9, 0xfc, 0xd8, 0x69, 0xe2, 0x58, 0x37, 0x07, 0x23}
+)
 
-	pubKeyDecoded, err := base64.StdEncoding.DecodeString(*response.PublicKey)
+// HashEmail returns the hash of an email address used for directory lookups. The address is
+// trimmed and converted to lowercase first.
+func HashEmail(email string) [32]byte {
+	return hmacSHA256(emailHashKey, strings.ToLower(strings.TrimSpace(email)))
+}
+
+// HashPhoneNumber returns the hash of a phone number used for directory lookups. The number must
+// be in international format, e.g. "+41 79 123 45 67". Everything but digits is removed first.
+func HashPhoneNumber(phone string) [32]byte {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+	return hmacSHA256(phoneHashKey, digits)
+}
+
+func hmacSHA256(key []byte, msg string) [32]byte {
+	var sum [32]byte
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// directoryEntry is an identity as returned by the directory lookups
+type directoryEntry struct {
+	Identity  string `json:"identity"`
+	PublicKey string `json:"publicKey"`
+}
+
+// contact converts the entry into a ThreemaContact with a key fetched from the server
+func (de directoryEntry) contact() (ThreemaContact, error) {
+	id, err := ParseIDString(de.Identity)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	pk, err := base64.StdEncoding.DecodeString(de.PublicKey)
 	if err != nil {
 		return ThreemaContact{}, err
 	}
-	var pubKey [32]byte
-	copy(pubKey[:], (pubKeyDecoded[:32]))
+	if len(pk) != 32 {
+		return ThreemaContact{}, fmt.Errorf("%s: invalid public key length: %d", de.Identity, len(pk))
+	}
+	contact := ThreemaContact{ID: id, Level: SERVERFETCHED}
+	copy(contact.LPK[:], pk)
+	return contact, nil
+}
+
+// GetContactByEmail returns the contact linked to the given email address
+func (tr ThreemaRest) GetContactByEmail(email string) (ThreemaContact, error) {
+	hash := HashEmail(email)
+	var entry directoryEntry
+	if err := tr.getJSON("identity/by_email_hash/"+hex.EncodeToString(hash[:]), &entry); err != nil {
+		return ThreemaContact{}, err
+	}
+	return entry.contact()
+}
+
+// GetContactByPhoneNumber returns the contact linked to the given phone number
+func (tr ThreemaRest) GetContactByPhoneNumber(phone string) (ThreemaContact, error) {
+	hash := HashPhoneNumber(phone)
+	var entry directoryEntry
+	if err := tr.getJSON("identity/by_mobile_hash/"+hex.EncodeToString(hash[:]), &entry); err != nil {
+		return ThreemaContact{}, err
+	}
+	return entry.contact()
+}
+
+// MatchContacts looks up the contacts linked to any of the given email addresses and phone numbers
+// in a single request. Addresses and numbers without a linked ID are skipped. The returned contacts
+// can be added to an AddressBook using Pin.
+func (tr ThreemaRest) MatchContacts(emails, phones []string) ([]ThreemaContact, error) {
+	request := struct {
+		EmailHashes    []string `json:"emailHashes"`
+		MobileNoHashes []string `json:"mobileNoHashes"`
+	}{make([]string, len(emails)), make([]string, len(phones))}
+	for i, email := range emails {
+		hash := HashEmail(email)
+		request.EmailHashes[i] = base64.StdEncoding.EncodeToString(hash[:])
+	}
+	for i, phone := range phones {
+		hash := HashPhoneNumber(phone)
+		request.MobileNoHashes[i] = base64.StdEncoding.EncodeToString(hash[:])
+	}
 
-	return ThreemaContact{
-		ID:  [8]byte(thIDString),
-		LPK: pubKey}, nil
+	var response struct {
+		Identities []directoryEntry `json:"identities"`
+	}
+	if err := tr.postJSON("identity/match", request, &response); err != nil {
+		return nil, err
+	}
+
+	contacts := make([]ThreemaContact, 0, len(response.Identities))
+	for _, entry := range response.Identities {
+		contact, err := entry.contact()
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
 }
@@ -0,0 +1,680 @@
+package o3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeAPI plays the directory server for the identities registered in keys
+type fakeAPI struct {
+	mu     sync.Mutex
+	keys   map[string][32]byte
+	masks  map[string]FeatureMask
+	tokens map[string][32]byte // token -> secret key of the challenge
+	hashes map[[32]byte]string // email or phone hash -> identity
+	links  map[string]string   // identity -> linked email or phone number
+	codes  map[string]string   // verification ID -> pending phone number link
+	revKey map[string]string   // identity -> revocation key
+	// maskRequests counts the feature mask requests
+	maskRequests int
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		keys:   make(map[string][32]byte),
+		masks:  make(map[string]FeatureMask),
+		tokens: make(map[string][32]byte),
+		hashes: make(map[[32]byte]string),
+		links:  make(map[string]string),
+		codes:  make(map[string]string),
+		revKey: make(map[string]string)}
+}
+
+// entry returns the directory entry of id
+func (fa *fakeAPI) entry(id string) directoryEntry {
+	pk := fa.keys[id]
+	return directoryEntry{Identity: id, PublicKey: base64.StdEncoding.EncodeToString(pk[:])}
+}
+
+// challenge returns a new token challenge
+func (fa *fakeAPI) challenge(t *testing.T) apiChallenge {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+	tokenB64 := base64.StdEncoding.EncodeToString(token)
+	fa.tokens[tokenB64] = *sk
+	return apiChallenge{Token: tokenB64, TokenRespKeyPub: base64.StdEncoding.EncodeToString(pk[:])}
+}
+
+// verify checks the response to a challenge made using the private key belonging to pk
+func (fa *fakeAPI) verify(pk [32]byte, token, response string) bool {
+	sk, ok := fa.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(fa.tokens, token)
+	resp, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return false
+	}
+	plain, ok := box.Open(nil, resp, &challengeNonce, &pk, &sk)
+	return ok && base64.StdEncoding.EncodeToString(plain) == token
+}
+
+func (fa *fakeAPI) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identity/create", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			PublicKey string
+			Token     string
+			Response  string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token == "" {
+			json.NewEncoder(w).Encode(fa.challenge(t))
+			return
+		}
+		var pk [32]byte
+		raw, _ := base64.StdEncoding.DecodeString(req.PublicKey)
+		copy(pk[:], raw)
+		if !fa.verify(pk, req.Token, req.Response) {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid response"})
+			return
+		}
+		id := fmt.Sprintf("TESTID%02d", len(fa.keys))
+		fa.keys[id] = pk
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "identity": id})
+	})
+	mux.HandleFunc("/identity/", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		if r.UserAgent() != DefaultUserAgent {
+			http.Error(w, "unexpected user agent", http.StatusBadRequest)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/identity/")
+		if _, ok := fa.keys[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(fa.entry(id))
+	})
+	byHash := func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var hash [32]byte
+		raw, _ := hex.DecodeString(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		copy(hash[:], raw)
+		id, ok := fa.hashes[hash]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(fa.entry(id))
+	}
+	mux.HandleFunc("/identity/by_email_hash/", byHash)
+	mux.HandleFunc("/identity/by_mobile_hash/", byHash)
+	mux.HandleFunc("/identity/match", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			EmailHashes    []string
+			MobileNoHashes []string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := struct {
+			Identities []directoryEntry `json:"identities"`
+		}{[]directoryEntry{}}
+		for _, h := range append(req.EmailHashes, req.MobileNoHashes...) {
+			var hash [32]byte
+			raw, _ := base64.StdEncoding.DecodeString(h)
+			copy(hash[:], raw)
+			if id, ok := fa.hashes[hash]; ok {
+				resp.Identities = append(resp.Identities, fa.entry(id))
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/identity/set_featuremask", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			Identity    string
+			FeatureMask FeatureMask
+			Token       string
+			Response    string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token == "" {
+			json.NewEncoder(w).Encode(fa.challenge(t))
+			return
+		}
+		if !fa.verify(fa.keys[req.Identity], req.Token, req.Response) {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid response"})
+			return
+		}
+		fa.masks[req.Identity] = req.FeatureMask
+		json.NewEncoder(w).Encode(apiResult{Success: true})
+	})
+	link := func(kind string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fa.mu.Lock()
+			defer fa.mu.Unlock()
+			var req struct {
+				Identity string
+				Email    string
+				MobileNo string
+				Token    string
+				Response string
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			value := kind + ":" + req.Email + req.MobileNo
+			if req.Token == "" {
+				// like the server, report whether the requested state holds already, in which
+				// case there is no challenge to answer
+				linked := fa.links[req.Identity] == value
+				if value == kind+":" {
+					linked = !strings.HasPrefix(fa.links[req.Identity], value)
+				}
+				if linked {
+					json.NewEncoder(w).Encode(map[string]bool{"linked": true})
+					return
+				}
+				json.NewEncoder(w).Encode(struct {
+					apiChallenge
+					Linked bool `json:"linked"`
+				}{fa.challenge(t), false})
+				return
+			}
+			if !fa.verify(fa.keys[req.Identity], req.Token, req.Response) {
+				json.NewEncoder(w).Encode(apiResult{Error: "invalid response"})
+				return
+			}
+			switch {
+			case value == kind+":":
+				delete(fa.links, req.Identity)
+				json.NewEncoder(w).Encode(apiResult{Success: true})
+			case kind == "email":
+				fa.links[req.Identity] = value
+				json.NewEncoder(w).Encode(apiResult{Success: true})
+			default:
+				id := fmt.Sprintf("verification%d", len(fa.codes))
+				fa.codes[id] = req.Identity + "=" + value
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "verificationId": id})
+			}
+		}
+	}
+	mux.HandleFunc("/identity/link_email", link("email"))
+	mux.HandleFunc("/identity/link_mobileno", link("mobile"))
+	mux.HandleFunc("/identity/link_mobileno_code", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			VerificationID string
+			Code           string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		pending, ok := fa.codes[req.VerificationID]
+		if !ok || req.Code != "123456" {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid code"})
+			return
+		}
+		parts := strings.SplitN(pending, "=", 2)
+		fa.links[parts[0]] = parts[1]
+		delete(fa.codes, req.VerificationID)
+		json.NewEncoder(w).Encode(apiResult{Success: true})
+	})
+	mux.HandleFunc("/identity/link_mobileno_call", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct{ VerificationID string }
+		json.NewDecoder(r.Body).Decode(&req)
+		_, ok := fa.codes[req.VerificationID]
+		json.NewEncoder(w).Encode(apiResult{Success: ok})
+	})
+	mux.HandleFunc("/identity/set_revocation_key", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			Identity      string
+			RevocationKey string
+			Token         string
+			Response      string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token == "" {
+			json.NewEncoder(w).Encode(fa.challenge(t))
+			return
+		}
+		if !fa.verify(fa.keys[req.Identity], req.Token, req.Response) {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid response"})
+			return
+		}
+		fa.revKey[req.Identity] = req.RevocationKey
+		json.NewEncoder(w).Encode(apiResult{Success: true})
+	})
+	mux.HandleFunc("/identity/check_revocation_key", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct {
+			Identity string
+			Token    string
+			Response string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token == "" {
+			json.NewEncoder(w).Encode(fa.challenge(t))
+			return
+		}
+		if !fa.verify(fa.keys[req.Identity], req.Token, req.Response) {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid response"})
+			return
+		}
+		resp := map[string]interface{}{"success": true, "revocationKeySet": false}
+		if _, ok := fa.revKey[req.Identity]; ok {
+			resp["revocationKeySet"] = true
+			resp["lastChanged"] = "2017-06-01T12:00:00+0000"
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/identity/revoke", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		var req struct{ Identity, Key string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if key, ok := fa.revKey[req.Identity]; !ok || key != req.Key {
+			json.NewEncoder(w).Encode(apiResult{Error: "invalid revocation key"})
+			return
+		}
+		delete(fa.keys, req.Identity)
+		json.NewEncoder(w).Encode(apiResult{Success: true})
+	})
+	mux.HandleFunc("/identity/check_featuremask", func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.Lock()
+		defer fa.mu.Unlock()
+		fa.maskRequests++
+		var req struct{ Identities []string }
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := struct {
+			FeatureMasks []*FeatureMask `json:"featureMasks"`
+		}{make([]*FeatureMask, len(req.Identities))}
+		for i, id := range req.Identities {
+			if _, ok := fa.keys[id]; ok {
+				fm := fa.masks[id]
+				resp.FeatureMasks[i] = &fm
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
+
+func TestFeatureMasks(t *testing.T) {
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid, err := NewThreemaID("TESTSELF", *sk, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.keys["TESTSELF"] = *pk
+	fa.keys["OLDPEER1"] = [32]byte{1}
+	fa.keys["NEWPEER1"] = [32]byte{2}
+	fa.masks["NEWPEER1"] = FEATUREAUDIO | FEATUREGROUPS | FEATUREFILES
+	tid.Contacts.Add(ThreemaContact{ID: NewIDString("OLDPEER1"), LPK: [32]byte{1}})
+	tid.Contacts.Add(ThreemaContact{ID: NewIDString("NEWPEER1"), LPK: [32]byte{2}})
+
+	sc := NewSessionContext(tid)
+	sc.Rest.BaseURL = srv.URL
+
+	if err := sc.SetFeatureMask(DefaultFeatureMask); err != nil {
+		t.Fatal(err)
+	}
+	if fa.masks["TESTSELF"] != DefaultFeatureMask {
+		t.Errorf("server has feature mask %s", fa.masks["TESTSELF"])
+	}
+	wrongKey := sc.ID
+	wrongKey.LSK = [32]byte{9}
+	if err := sc.Rest.SetFeatureMask(wrongKey, FEATUREVOIP); err == nil {
+		t.Error("feature mask set without the private key")
+	}
+
+	masks, err := sc.FetchFeatureMasks("OLDPEER1", "NEWPEER1", "UNKNOWN1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(masks) != 2 || masks[NewIDString("NEWPEER1")] != fa.masks["NEWPEER1"] {
+		t.Errorf("fetched feature masks %v", masks)
+	}
+	if c, _ := sc.ID.Contacts.Get("NEWPEER1"); !c.FeatureMask.Has(FEATUREFILES) {
+		t.Errorf("feature mask not cached: %s", c.FeatureMask)
+	}
+
+	if err := sc.SendAudioMessage("OLDPEER1", "test/audio.mp3", make(chan Message, 1)); err == nil {
+		t.Error("audio message sent to a client without audio support")
+	} else if uf, ok := err.(UnsupportedFeature); !ok || uf.Feature != FEATUREAUDIO {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	sendMsgChan := make(chan Message, 3)
+	group := Group{
+		CreatorID: tid.ID,
+		GroupID:   [8]byte{1},
+		Members:   []IDString{NewIDString("OLDPEER1"), NewIDString("NEWPEER1")}}
+	if err := sc.SendGroupTextMessage(group, "hello", sendMsgChan); err == nil {
+		t.Error("group message sent to a client without group support")
+	} else if uf, ok := err.(UnsupportedFeature); !ok || uf.ID != NewIDString("OLDPEER1") || uf.Feature != FEATUREGROUPS {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(sendMsgChan) != 0 {
+		t.Errorf("%d messages sent to a group with an unsupported member", len(sendMsgChan))
+	}
+	group.Members = group.Members[1:]
+	if err := sc.SendGroupTextMessage(group, "hello", sendMsgChan); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := (<-sendMsgChan).(GroupTextMessage); !ok || msg.Recipient() != NewIDString("NEWPEER1") {
+		t.Errorf("expected group message: %#v", msg)
+	}
+
+	if s := (FEATUREAUDIO | FEATUREVOIP | 0x40).String(); s != "audio,voip,0x40" {
+		t.Errorf("FeatureMask.String() = %q", s)
+	}
+	if FeatureMask(0).String() != "none" {
+		t.Errorf("empty FeatureMask.String() = %q", FeatureMask(0).String())
+	}
+}
+
+func TestGroupFeatureMaskFetch(t *testing.T) {
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	sc := NewSessionContext(ThreemaID{ID: NewIDString("TESTSELF"), Contacts: NewAddressBook()})
+	sc.Rest = NewThreemaRest(srv.URL, srv.Client())
+	members := []IDString{NewIDString("TESTSELF"), NewIDString("PEER0001"), NewIDString("PEER0002"), NewIDString("PEER0003")}
+	for i, id := range members[1:] {
+		fa.keys[id.String()] = [32]byte{byte(i + 1)}
+		sc.ID.Contacts.Add(ThreemaContact{ID: id, LPK: [32]byte{byte(i + 1)}})
+	}
+	fa.masks["PEER0001"] = DefaultFeatureMask
+	group := Group{CreatorID: sc.ID.ID, GroupID: [8]byte{1}, Members: members}
+
+	send := func() error {
+		msgs := make(chan Message, len(members))
+		err := sc.SendGroupTextMessage(group, "hello", msgs)
+		if err == nil && len(msgs) != len(members) {
+			t.Errorf("%d group messages sent", len(msgs))
+		}
+		return err
+	}
+	if err, ok := send().(UnsupportedFeature); !ok || err.ID != NewIDString("PEER0002") || fa.maskRequests != 1 {
+		t.Errorf("unexpected error %v after %d feature mask requests", err, fa.maskRequests)
+	}
+	// Clients known to lack group support are not asked again on every message
+	if err, ok := send().(UnsupportedFeature); !ok || err.ID != NewIDString("PEER0002") || fa.maskRequests != 1 {
+		t.Errorf("unexpected error %v after %d feature mask requests", err, fa.maskRequests)
+	}
+
+	for _, id := range []string{"PEER0002", "PEER0003"} {
+		fa.masks[id] = DefaultFeatureMask
+		c, _ := sc.ID.Contacts.Get(id)
+		c.FeatureMaskFetched = time.Now().Add(-featureMaskMaxAge)
+		sc.ID.Contacts.Add(c)
+	}
+	if err := send(); err != nil || fa.maskRequests != 2 {
+		t.Errorf("unexpected error %v after %d feature mask requests", err, fa.maskRequests)
+	}
+}
+
+func TestThreemaRest(t *testing.T) {
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	tr := NewThreemaRest(srv.URL, srv.Client())
+	tid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fa.keys[tid.String()] != *tid.GetPubKey() {
+		t.Errorf("server registered %x for %s", fa.keys[tid.String()], tid)
+	}
+	if fa.masks[tid.String()] != DefaultFeatureMask {
+		t.Errorf("feature mask %s set for new ID", fa.masks[tid.String()])
+	}
+
+	contact, err := tr.GetContactByID(tid.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.LPK != *tid.GetPubKey() {
+		t.Errorf("fetched key %x", contact.LPK)
+	}
+	if _, err := tr.GetContactByID(NewIDString("UNKNOWN1")); err == nil {
+		t.Error("unknown ID fetched")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tr.WithContext(ctx).GetContactByID(tid.ID); err == nil {
+		t.Error("request with canceled context succeeded")
+	}
+
+	// the session uses its configured ThreemaRest to look up unknown contacts
+	self, err := NewThreemaID("TESTSELF", [32]byte{1}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSessionContext(self)
+	sc.Rest = tr
+	if contact, err := sc.lookupContact(tid.ID); err != nil || contact.LPK != *tid.GetPubKey() || contact.Level != SERVERFETCHED {
+		t.Errorf("looked up %#v, %v", contact, err)
+	}
+}
+
+func TestContactDiscovery(t *testing.T) {
+	// test vectors from the Threema Gateway documentation
+	if h := HashEmail(" Test@Threema.ch"); hex.EncodeToString(h[:]) != "1ea093239cc5f0e1b6ec81b866265b921f26dc4033025410063309f4d1a8ee2c" {
+		t.Errorf("email hash %x", h)
+	}
+	if h := HashPhoneNumber("+41 79 123 45 67"); hex.EncodeToString(h[:]) != "ad398f4d7ebe63c6550a486cc6e07f9baa09bd9d8b3d8cb9d9be106d35a7fdbc" {
+		t.Errorf("phone hash %x", h)
+	}
+
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+	fa.keys["EMAILID1"] = [32]byte{1}
+	fa.keys["PHONEID1"] = [32]byte{2}
+	fa.hashes[HashEmail("alice@example.com")] = "EMAILID1"
+	fa.hashes[HashPhoneNumber("41791234567")] = "PHONEID1"
+
+	tr := NewThreemaRest(srv.URL, srv.Client())
+	if c, err := tr.GetContactByEmail("Alice@example.com"); err != nil || c.ID != NewIDString("EMAILID1") || c.LPK != fa.keys["EMAILID1"] {
+		t.Errorf("email lookup: %#v, %v", c, err)
+	}
+	if c, err := tr.GetContactByPhoneNumber("+41 79 123 45 67"); err != nil || c.ID != NewIDString("PHONEID1") || c.Level != SERVERFETCHED {
+		t.Errorf("phone lookup: %#v, %v", c, err)
+	}
+	if _, err := tr.GetContactByEmail("bob@example.com"); err == nil {
+		t.Error("lookup of unknown email succeeded")
+	}
+
+	contacts, err := tr.MatchContacts(
+		[]string{"alice@example.com", "bob@example.com"},
+		[]string{"+41791234567", "+41790000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab := NewAddressBook()
+	for _, c := range contacts {
+		if _, err := ab.Pin(c); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(contacts) != 2 || len(ab.Contacts()) != 2 {
+		t.Errorf("matched %v", contacts)
+	}
+	if c, ok := ab.Get("PHONEID1"); !ok || c.LPK != fa.keys["PHONEID1"] {
+		t.Errorf("matched contact not imported: %#v", c)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	tr := NewThreemaRest(srv.URL, srv.Client())
+	tid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := tid.String()
+
+	if linked, err := tr.LinkEmail(tid, "bot@example.com", "en"); err != nil || linked {
+		t.Fatalf("link email: %v, %v", linked, err)
+	}
+	if fa.links[id] != "email:bot@example.com" {
+		t.Errorf("server has link %q", fa.links[id])
+	}
+	if linked, err := tr.LinkEmail(tid, "bot@example.com", "en"); err != nil || !linked {
+		t.Errorf("linking again: %v, %v", linked, err)
+	}
+	if err := tr.UnlinkEmail(tid); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fa.links[id]; ok {
+		t.Errorf("email still linked: %q", fa.links[id])
+	}
+	if linked, err := tr.LinkEmail(tid, "", ""); err != nil || !linked {
+		t.Errorf("unlinking again: %v, %v", linked, err)
+	}
+
+	wrongKey := tid
+	wrongKey.LSK = [32]byte{1}
+	if _, err := tr.LinkEmail(wrongKey, "bot@example.com", "en"); err == nil {
+		t.Error("email linked without the private key")
+	}
+
+	verificationID, err := tr.LinkMobileNo(tid, "41791234567", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.RequestVerificationCall(verificationID); err != nil {
+		t.Error(err)
+	}
+	if err := tr.VerifyMobileNo(verificationID, "000000"); err == nil {
+		t.Error("wrong verification code accepted")
+	}
+	if err := tr.VerifyMobileNo(verificationID, "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if fa.links[id] != "mobile:41791234567" {
+		t.Errorf("server has link %q", fa.links[id])
+	}
+	if _, err := tr.LinkMobileNo(tid, "41791234567", "en"); err == nil {
+		t.Error("linked mobile number accepted again")
+	}
+	if err := tr.UnlinkMobileNo(tid); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fa.links[id]; ok {
+		t.Errorf("mobile number still linked: %q", fa.links[id])
+	}
+	if err := tr.UnlinkMobileNo(tid); err != nil {
+		t.Errorf("unlinking again: %v", err)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	if key := RevocationKey("correct horse"); len(key) != 8 {
+		t.Errorf("revocation key %q is not 4 bytes", key)
+	}
+
+	fa := newFakeAPI()
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	tr := NewThreemaRest(srv.URL, srv.Client())
+	tid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set, _, err := tr.CheckRevocationKey(tid); err != nil || set {
+		t.Fatalf("check before setting: %v, %v", set, err)
+	}
+	if err := tr.SetRevocationKey(tid, ""); err == nil {
+		t.Error("empty revocation password accepted")
+	}
+	if err := tr.SetRevocationKey(tid, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	set, lastChanged, err := tr.CheckRevocationKey(tid)
+	if err != nil || !set {
+		t.Fatalf("check after setting: %v, %v", set, err)
+	}
+	if want := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC); !lastChanged.Equal(want) {
+		t.Errorf("lastChanged is %v", lastChanged)
+	}
+
+	if err := tr.RevokeIdentity(tid.ID, "wrong horse"); err == nil {
+		t.Error("identity revoked with the wrong password")
+	}
+	if err := tr.RevokeIdentity(tid.ID, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.GetContactByID(tid.ID); err == nil {
+		t.Error("revoked identity still in the directory")
+	}
+}
+
+func TestSignedRequestErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(apiResult{Error: "rate limit exceeded"})
+	}))
+	defer srv.Close()
+
+	tr := NewThreemaRest(srv.URL, srv.Client())
+	if _, err := tr.CreateIdentity(); err == nil || !strings.Contains(err.Error(), "rate limit exceeded") {
+		t.Errorf("unexpected error for rejected challenge: %v", err)
+	}
+
+	fa := newFakeAPI()
+	api := httptest.NewServer(fa.handler(t))
+	defer api.Close()
+
+	tr = NewThreemaRest(api.URL, api.Client())
+	tid, err := tr.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.LSK = [32]byte{1}
+	if err := tr.SetFeatureMask(tid, FEATUREAUDIO); err == nil || !strings.Contains(err.Error(), "invalid response") {
+		t.Errorf("unexpected error for wrong private key: %v", err)
+	}
+}
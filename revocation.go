@@ -0,0 +1,73 @@
+package o3
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RevocationKey derives the key stored on the directory server from a revocation password. Only the
+// first four bytes of its SHA-256 hash are kept, so the password cannot be recovered from the key.
+func RevocationKey(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return base64.StdEncoding.EncodeToString(sum[:4])
+}
+
+// revocationTimeLayouts are the formats lastChanged has been seen in
+var revocationTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05-0700"}
+
+// SetRevocationKey sets the password that allows revoking thid without its private key, e.g. when
+// the private key was leaked or lost. An empty password is rejected.
+func (tr ThreemaRest) SetRevocationKey(thid ThreemaID, password string) error {
+	if password == "" {
+		return errors.New("empty revocation password")
+	}
+	request := struct {
+		Identity      string `json:"identity"`
+		RevocationKey string `json:"revocationKey"`
+	}{thid.String(), RevocationKey(password)}
+
+	return tr.signedRequest("identity/set_revocation_key", request, &thid.LSK, nil)
+}
+
+// CheckRevocationKey reports whether a revocation password has been set for thid and when it was
+// last changed. lastChanged is the zero time if the server does not know.
+func (tr ThreemaRest) CheckRevocationKey(thid ThreemaID) (set bool, lastChanged time.Time, err error) {
+	request := struct {
+		Identity string `json:"identity"`
+	}{thid.String()}
+
+	var result struct {
+		RevocationKeySet bool   `json:"revocationKeySet"`
+		LastChanged      string `json:"lastChanged"`
+	}
+	if err := tr.signedRequest("identity/check_revocation_key", request, &thid.LSK, &result); err != nil {
+		return false, time.Time{}, err
+	}
+	if result.LastChanged == "" {
+		return result.RevocationKeySet, time.Time{}, nil
+	}
+	for _, layout := range revocationTimeLayouts {
+		if lastChanged, err = time.Parse(layout, result.LastChanged); err == nil {
+			return result.RevocationKeySet, lastChanged, nil
+		}
+	}
+	return result.RevocationKeySet, time.Time{}, fmt.Errorf("invalid lastChanged time: %q", result.LastChanged)
+}
+
+// RevokeIdentity permanently revokes the ID using its revocation password. No private key is
+// needed, so a leaked or lost identity can be revoked as well. This cannot be undone.
+func (tr ThreemaRest) RevokeIdentity(id IDString, password string) error {
+	request := struct {
+		Identity string `json:"identity"`
+		Key      string `json:"key"`
+	}{id.String(), RevocationKey(password)}
+
+	var result apiResult
+	if err := tr.postJSON("identity/revoke", request, &result); err != nil {
+		return err
+	}
+	return result.err("revoking identity")
+}
@@ -0,0 +1,444 @@
+package o3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Threema Safe is the backup facility of the official apps. A backup holds the identity, contacts,
+// groups and settings as gzip compressed JSON. It is encrypted with a key derived from the ID and
+// a password and stored on a Safe server under an ID derived the same way.
+
+const (
+	safeVersion           = 1
+	safeMinPasswordLength = 8
+	safeUserAgent         = "Threema/2.8"
+)
+
+// ErrSafeBackupNotFound is returned by SafeClient if the server does not hold a backup for the ID
+var ErrSafeBackupNotFound = errors.New("no Threema Safe backup found")
+
+// SafeBackup is the content of a Threema Safe backup. Settings holds the settings object of the
+// backup as decoded by encoding/json so settings of the official apps survive a restore. The
+// blocked state of contacts is stored in the "blockedContacts" setting.
+type SafeBackup struct {
+	ID       ThreemaID
+	Settings map[string]interface{}
+}
+
+// NewSafeBackup returns a SafeBackup of the given ID with empty settings
+func NewSafeBackup(thid ThreemaID) *SafeBackup {
+	return &SafeBackup{
+		ID:       thid,
+		Settings: make(map[string]interface{})}
+}
+
+type safeFile struct {
+	Info     safeInfo               `json:"info"`
+	User     safeUser               `json:"user"`
+	Contacts []safeContact          `json:"contacts"`
+	Groups   []safeGroup            `json:"groups"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+type safeInfo struct {
+	Version int    `json:"version"`
+	Device  string `json:"device,omitempty"`
+}
+
+type safeUser struct {
+	PrivateKey string `json:"privatekey"`
+	Nickname   string `json:"nickname,omitempty"`
+}
+
+type safeContact struct {
+	Identity     string `json:"identity"`
+	PublicKey    string `json:"publickey,omitempty"`
+	CreatedAt    int64  `json:"createdAt,omitempty"`
+	Verification int    `json:"verification"`
+	Nickname     string `json:"nickname,omitempty"`
+	FirstName    string `json:"firstname,omitempty"`
+}
+
+type safeGroup struct {
+	ID        string   `json:"id"`
+	Creator   string   `json:"creator"`
+	GroupName string   `json:"groupname,omitempty"`
+	Members   []string `json:"members"`
+	Deleted   bool     `json:"deleted"`
+}
+
+// DeriveSafeKey derives the backup ID and the encryption key of the Threema Safe backup of the
+// given ID from password using scrypt
+func DeriveSafeKey(id string, password []byte) (backupID, key [32]byte, err error) {
+	if len(password) < safeMinPasswordLength {
+		return backupID, key, fmt.Errorf("Threema Safe password must be at least %d characters long", safeMinPasswordLength)
+	}
+	master, err := scrypt.Key(password, []byte(id), 65536, 8, 1, 64)
+	if err != nil {
+		return backupID, key, err
+	}
+	copy(backupID[:], master[:32])
+	copy(key[:], master[32:])
+	return backupID, key, nil
+}
+
+// MarshalJSON encodes the backup in the JSON format used by Threema Safe
+func (sb *SafeBackup) MarshalJSON() ([]byte, error) {
+	sf := safeFile{
+		Info: safeInfo{Version: safeVersion, Device: "o3"},
+		User: safeUser{
+			PrivateKey: base64.StdEncoding.EncodeToString(sb.ID.LSK[:]),
+			Nickname:   strings.TrimRight(sb.ID.Nick.String(), "\x00")},
+		Contacts: []safeContact{},
+		Groups:   []safeGroup{},
+		Settings: make(map[string]interface{})}
+	for k, v := range sb.Settings {
+		sf.Settings[k] = v
+	}
+
+	blocked := []string{}
+	for id, c := range sb.ID.Contacts.Contacts() {
+		sc := safeContact{
+			Identity:     id,
+			Verification: int(c.Level),
+			Nickname:     c.Nickname,
+			FirstName:    c.Name}
+		if c.LPK != ([32]byte{}) {
+			sc.PublicKey = base64.StdEncoding.EncodeToString(c.LPK[:])
+		}
+		if !c.FirstSeen.IsZero() {
+			sc.CreatedAt = c.FirstSeen.UnixNano() / int64(time.Millisecond)
+		}
+		sf.Contacts = append(sf.Contacts, sc)
+		if c.Blocked {
+			blocked = append(blocked, id)
+		}
+	}
+	if len(blocked) > 0 {
+		sf.Settings["blockedContacts"] = blocked
+	}
+
+	for _, g := range sb.ID.Groups.List() {
+		sg := safeGroup{
+			ID:        hex.EncodeToString(g.GroupID[:]),
+			Creator:   g.CreatorID.String(),
+			GroupName: g.Name,
+			Members:   make([]string, len(g.Members))}
+		for i, m := range g.Members {
+			sg.Members[i] = m.String()
+		}
+		sf.Groups = append(sf.Groups, sg)
+	}
+
+	return json.Marshal(sf)
+}
+
+// decodeSafeBackup parses the JSON of a Threema Safe backup of the given ID
+func decodeSafeBackup(id string, data []byte) (*SafeBackup, error) {
+	var sf safeFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, err
+	}
+	if sf.Info.Version != safeVersion {
+		return nil, fmt.Errorf("unsupported Threema Safe backup version: %d", sf.Info.Version)
+	}
+
+	tid, err := ParseIDString(id)
+	if err != nil {
+		return nil, err
+	}
+	thid := ThreemaID{
+		ID:       tid,
+		Nick:     NewPubNick(sf.User.Nickname),
+		Contacts: NewAddressBook(),
+		Groups:   NewGroupBook()}
+	lsk, err := base64.StdEncoding.DecodeString(sf.User.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(lsk) != 32 {
+		return nil, fmt.Errorf("invalid private key length in backup: %d", len(lsk))
+	}
+	copy(thid.LSK[:], lsk)
+
+	blocked := make(map[string]bool)
+	if list, ok := sf.Settings["blockedContacts"].([]interface{}); ok {
+		for _, b := range list {
+			if s, ok := b.(string); ok {
+				blocked[s] = true
+			}
+		}
+	}
+
+	for _, sc := range sf.Contacts {
+		cid, err := ParseIDString(sc.Identity)
+		if err != nil {
+			return nil, err
+		}
+		c := ThreemaContact{
+			ID:       cid,
+			Name:     sc.FirstName,
+			Level:    VerificationLevel(sc.Verification),
+			Nickname: sc.Nickname,
+			Blocked:  blocked[sc.Identity]}
+		if sc.PublicKey != "" {
+			pk, err := base64.StdEncoding.DecodeString(sc.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			if len(pk) != 32 {
+				return nil, fmt.Errorf("contact %s: invalid public key length: %d", sc.Identity, len(pk))
+			}
+			copy(c.LPK[:], pk)
+		}
+		if sc.CreatedAt != 0 {
+			c.FirstSeen = time.Unix(0, sc.CreatedAt*int64(time.Millisecond))
+		}
+		thid.Contacts.Add(c)
+	}
+
+	for _, sg := range sf.Groups {
+		if sg.Deleted {
+			continue
+		}
+		creator, err := ParseIDString(sg.Creator)
+		if err != nil {
+			return nil, err
+		}
+		g := Group{
+			CreatorID: creator,
+			Name:      sg.GroupName,
+			Members:   make([]IDString, len(sg.Members))}
+		gid, err := hex.DecodeString(sg.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(gid) != 8 {
+			return nil, fmt.Errorf("group of %s: invalid group ID length: %d", sg.Creator, len(gid))
+		}
+		copy(g.GroupID[:], gid)
+		for i, m := range sg.Members {
+			if g.Members[i], err = ParseIDString(m); err != nil {
+				return nil, fmt.Errorf("group of %s: %s", sg.Creator, err)
+			}
+		}
+		thid.Groups.Add(g)
+	}
+
+	sb := NewSafeBackup(thid)
+	for k, v := range sf.Settings {
+		sb.Settings[k] = v
+	}
+	return sb, nil
+}
+
+// Encrypt compresses and encrypts the backup with key. The result is the nonce followed by the
+// XSalsa20 and Poly1305 sealed gzip stream as stored on the Safe server.
+func (sb *SafeBackup) Encrypt(key [32]byte) ([]byte, error) {
+	plain, err := json.Marshal(sb)
+	if err != nil {
+		return nil, err
+	}
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	if _, err := zw.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	n := newRandomNonce()
+	return secretbox.Seal(n.byteSlice(), zbuf.Bytes(), n.bytes(), &key), nil
+}
+
+// DecryptSafeBackup decrypts and parses an encrypted Threema Safe backup of the given ID
+func DecryptSafeBackup(id string, data []byte, key [32]byte) (*SafeBackup, error) {
+	if len(data) < 24+secretbox.Overhead {
+		return nil, errors.New("Threema Safe backup too short")
+	}
+	var n nonce
+	n.set(data[:24])
+	compressed, ok := secretbox.Open(nil, data[24:], n.bytes(), &key)
+	if !ok {
+		return nil, errors.New("Verification failed. Wrong password?")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSafeBackup(id, plain)
+}
+
+// SafeConfig is the configuration announced by a Safe server
+type SafeConfig struct {
+	MaxBackupBytes int `json:"maxBackupBytes"`
+	RetentionDays  int `json:"retentionDays"`
+}
+
+// SafeClient talks to a Threema Safe server
+type SafeClient struct {
+	// ServerURL is the base URL of the server. If empty, the official server responsible for
+	// the backup ID is used.
+	ServerURL string
+	// Username and Password are sent as basic auth credentials if Username is not empty
+	Username string
+	Password string
+	// Client is used for all requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewSafeClient returns a SafeClient for the server at serverURL. Pass an empty string to use the
+// official servers.
+func NewSafeClient(serverURL string) *SafeClient {
+	return &SafeClient{ServerURL: serverURL}
+}
+
+func (c *SafeClient) serverURL(backupID [32]byte) string {
+	if c.ServerURL != "" {
+		return strings.TrimRight(c.ServerURL, "/")
+	}
+	return fmt.Sprintf("https://safe-%.2x.threema.ch", backupID[0])
+}
+
+func (c *SafeClient) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", safeUserAgent)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// Config fetches the configuration of the server holding the backup with the given ID
+func (c *SafeClient) Config(backupID [32]byte) (SafeConfig, error) {
+	resp, err := c.do("GET", c.serverURL(backupID)+"/config", nil)
+	if err != nil {
+		return SafeConfig{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return SafeConfig{}, fmt.Errorf("fetching Threema Safe config failed: %s", resp.Status)
+	}
+
+	var config SafeConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return SafeConfig{}, err
+	}
+	return config, nil
+}
+
+func (c *SafeClient) backupURL(backupID [32]byte) string {
+	return c.serverURL(backupID) + "/backups/" + hex.EncodeToString(backupID[:])
+}
+
+// Upload stores the encrypted backup data under backupID
+func (c *SafeClient) Upload(backupID [32]byte, data []byte) error {
+	resp, err := c.do("PUT", c.backupURL(backupID), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading Threema Safe backup failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Download fetches the encrypted backup stored under backupID
+func (c *SafeClient) Download(backupID [32]byte) ([]byte, error) {
+	resp, err := c.do("GET", c.backupURL(backupID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSafeBackupNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading Threema Safe backup failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Delete removes the backup stored under backupID
+func (c *SafeClient) Delete(backupID [32]byte) error {
+	resp, err := c.do("DELETE", c.backupURL(backupID), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrSafeBackupNotFound
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("deleting Threema Safe backup failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Backup encrypts sb with password and uploads it, checking the size limit of the server first
+func (c *SafeClient) Backup(sb *SafeBackup, password []byte) error {
+	backupID, key, err := DeriveSafeKey(sb.ID.String(), password)
+	if err != nil {
+		return err
+	}
+	data, err := sb.Encrypt(key)
+	if err != nil {
+		return err
+	}
+
+	config, err := c.Config(backupID)
+	if err != nil {
+		return err
+	}
+	if config.MaxBackupBytes > 0 && len(data) > config.MaxBackupBytes {
+		return fmt.Errorf("Threema Safe backup too large: %d bytes, server accepts %d", len(data), config.MaxBackupBytes)
+	}
+
+	return c.Upload(backupID, data)
+}
+
+// Restore downloads and decrypts the backup of the given ID
+func (c *SafeClient) Restore(id string, password []byte) (*SafeBackup, error) {
+	backupID, key, err := DeriveSafeKey(id, password)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Download(backupID)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptSafeBackup(id, data, key)
+}
@@ -0,0 +1,139 @@
+package o3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSafeServer stores backups in memory like a Threema Safe server
+type fakeSafeServer struct {
+	mu      sync.Mutex
+	backups map[string][]byte
+}
+
+func (fs *fakeSafeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/config" {
+		w.Write([]byte(`{"maxBackupBytes":65536,"retentionDays":180}`))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/backups/")
+	if len(id) != 64 {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		fs.backups[id] = data
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		data, ok := fs.backups[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case "DELETE":
+		if _, ok := fs.backups[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(fs.backups, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSafeBackupRoundTrip(t *testing.T) {
+	tid, err := NewThreemaID("TESTSELF", [32]byte{1, 2, 3}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Nick = NewPubNick("Bot")
+	firstSeen := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	tid.Contacts.Add(ThreemaContact{
+		ID:        NewIDString("ECHOECHO"),
+		Name:      "Echo",
+		LPK:       [32]byte{4, 5, 6},
+		Level:     FULLYVERIFIED,
+		Nickname:  "echo",
+		Blocked:   true,
+		FirstSeen: firstSeen})
+	group := Group{
+		CreatorID: tid.ID,
+		GroupID:   [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Name:      "Ops",
+		Members:   []IDString{NewIDString("ECHOECHO"), tid.ID}}
+	tid.Groups.Add(group)
+
+	sb := NewSafeBackup(tid)
+	sb.Settings["syncContacts"] = true
+
+	fs := &fakeSafeServer{backups: make(map[string][]byte)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	client := NewSafeClient(srv.URL)
+	client.Username, client.Password = "user", "pass"
+
+	password := []byte("correct horse")
+	if err := client.Backup(sb, password); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.backups) != 1 {
+		t.Fatalf("%d backups stored", len(fs.backups))
+	}
+
+	if _, err := client.Restore("TESTSELF", []byte("wrong password")); err == nil {
+		t.Error("backup was decrypted using a wrong password")
+	}
+
+	restored, err := client.Restore("TESTSELF", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID.ID != tid.ID || restored.ID.LSK != tid.LSK || restored.ID.Nick != tid.Nick {
+		t.Errorf("identity did not round-trip: %s", restored.ID)
+	}
+	if restored.Settings["syncContacts"] != true {
+		t.Errorf("settings did not round-trip: %v", restored.Settings)
+	}
+	c, ok := restored.ID.Contacts.Get("ECHOECHO")
+	if !ok {
+		t.Fatal("contact missing after restore")
+	}
+	if c.LPK != [32]byte{4, 5, 6} || c.Level != FULLYVERIFIED || !c.Blocked || c.Name != "Echo" || !c.FirstSeen.Equal(firstSeen) {
+		t.Errorf("contact did not round-trip: %#v", c)
+	}
+	if got, ok := restored.ID.Groups.Get(group.CreatorID, group.GroupID); !ok || !reflect.DeepEqual(got, group) {
+		t.Errorf("group did not round-trip: %#v", got)
+	}
+
+	backupID, _, err := DeriveSafeKey("TESTSELF", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(backupID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Restore("TESTSELF", password); err != ErrSafeBackupNotFound {
+		t.Errorf("got %v after deleting the backup", err)
+	}
+
+	if _, _, err := DeriveSafeKey("TESTSELF", []byte("short")); err == nil {
+		t.Error("short password accepted")
+	}
+}
@@ -3,16 +3,17 @@ package o3
 import (
 	"crypto/rand"
 	"net"
+	"sync"
 
 	"golang.org/x/crypto/nacl/box"
 )
 
 // SessionContext is a passable structure containing all
 // established keys and nonces required for communication with
-// the server
+// the server. It must only be used through the pointer returned
+// by NewSessionContext.
 type SessionContext struct {
-	ID ThreemaID
-	//TODO it might make more sense in a lot of places to use pointers here
+	ID          ThreemaID
 	clientSPK   [32]byte //client short-term public key
 	clientSSK   [32]byte //client short-term secret key
 	serverSPK   [32]byte //server short-term public key
@@ -20,20 +21,39 @@ type SessionContext struct {
 	clientNonce nonce
 	serverNonce nonce
 	connection  net.Conn
+	sendMu      sync.Mutex //guards clientNonce and writes to connection
 	//receiveMsgChan chan ReceivedMsg
 	receiveMsgChan *dynRecvChan
 	//sendMsgChan    chan Message
 	sendMsgChan *dynSendChan
 	ErrorChan   chan error
-	echoCounter uint64
+	// Rest is used for directory lookups, e.g. of contacts' public keys and feature masks
+	Rest ThreemaRest
+	// Blobs is used to upload and download the blobs of media messages
+	Blobs BlobClient
+	// BlobCache keeps downloaded and uploaded media if set
+	BlobCache *BlobCache
+	// Images, if set, resizes and re-encodes images before they are sent. PNG and GIF images can
+	// only be sent then.
+	Images *ImageOptions
+	// Messages keeps the history of sent and received messages if set
+	Messages MessageStore
+	// KeyChangeChan receives a KeyChange whenever the server returns a public key for a contact
+	// that differs from the pinned one. Events are dropped if the channel is full.
+	KeyChangeChan chan KeyChange
+	echoCounter   uint64 //accessed atomically
 }
 
 // NewSessionContext returns a new SessionContext
-func NewSessionContext(ID ThreemaID) SessionContext {
-	sc := SessionContext{
+func NewSessionContext(ID ThreemaID) *SessionContext {
+	sc := &SessionContext{
 		serverLPK: [32]byte{69, 11, 151, 87, 53, 39, 159, 222, 203, 51, 19, 100, 143, 95, 198, 238, 159, 244, 54, 14, 169, 42, 140, 23, 81, 198, 97, 228, 192, 216, 201, 9},
 		ID:        ID}
 
+	// the send and receive loops share the books, they must exist before those start
+	sc.ID.Contacts.initialize()
+	sc.ID.Groups.initialize()
+
 	// New Session means new ephemeral keys and nonce
 	sc.clientNonce = newNonce()
 
@@ -47,8 +67,7 @@ func NewSessionContext(ID ThreemaID) SessionContext {
 	sc.receiveMsgChan = newDynRecvChan()
 	sc.sendMsgChan = newDynSendChan()
 	sc.ErrorChan = make(chan error, 100)
-
-	sc.echoCounter = 0
+	sc.KeyChangeChan = make(chan KeyChange, 100)
 
 	return sc
 }
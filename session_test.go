@@ -0,0 +1,376 @@
+package o3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeServer plays the chat server on the far end of a net.Pipe for a SessionContext whose
+// handshake has been skipped
+type fakeServer struct {
+	conn  net.Conn
+	sk    [32]byte
+	nonce nonce
+	sc    *SessionContext
+}
+
+func newFakeServer(t *testing.T, sc *SessionContext) *fakeServer {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+
+	fs := &fakeServer{conn: server, sk: *sk, sc: sc}
+	fs.nonce.initialize([16]byte{1, 2, 3}, 2)
+
+	sc.serverSPK = *pk
+	sc.serverNonce = fs.nonce
+	sc.connection = client
+	return fs
+}
+
+// send encrypts and frames a plaintext packet the way the server does
+func (fs *fakeServer) send(t *testing.T, plaintext []byte) {
+	fs.nonce.increaseCounter()
+	ct := box.Seal(nil, plaintext, fs.nonce.bytes(), &fs.sc.clientSPK, &fs.sk)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(ct)))
+	buf.Write(ct)
+	if _, err := fs.conn.Write(buf.Bytes()); err != nil {
+		t.Error(err)
+	}
+}
+
+// countFrames reads frames sent by the client until n have been received
+func (fs *fakeServer) countFrames(n int) error {
+	for i := 0; i < n; i++ {
+		length, err := receivePacketLength(fs.conn)
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(fs.conn, make([]byte, length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestConcurrentSendReceive(t *testing.T) {
+	const messages = 50
+
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := ThreemaContact{ID: NewIDString("TESTPEER"), LPK: *peerPK}
+
+	tid, err := NewThreemaID("TESTSELF", [32]byte{7}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Contacts.Add(peer)
+	sc := NewSessionContext(tid)
+	fs := newFakeServer(t, sc)
+
+	// the client sends one ack per received message and one packet per sent message
+	done := make(chan error)
+	go func() { done <- fs.countFrames(2 * messages) }()
+
+	go sc.receiveLoop()
+	fs.send(t, serializePktType(new(bytes.Buffer), connEstablished).Bytes())
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			tm, err := NewTextMessage(sc, peer.String(), fmt.Sprintf("to peer %d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sc.sendMsgChan.In <- tm
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			tm := TextMessage{
+				messageHeader{sender: peer.ID, recipient: tid.ID, id: uint64(i), time: time.Now()},
+				textMessageBody{text: fmt.Sprintf("from peer %d", i)}}
+			n := newRandomNonce()
+			mp := messagePacket{
+				PktType:    deliveringMsg,
+				Sender:     peer.ID,
+				Recipient:  tid.ID,
+				ID:         uint64(i),
+				Time:       time.Now(),
+				Nonce:      n,
+				Ciphertext: box.Seal(nil, tm.Serialize(), n.bytes(), tid.GetPubKey(), peerSK),
+			}
+			fs.send(t, serializeMsgPkt(mp).Bytes())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			id := NewIDString(fmt.Sprintf("OTHER%03d", i))
+			sc.ID.Contacts.Add(ThreemaContact{ID: id})
+			sc.ID.Contacts.Get(peer.String())
+			sc.ID.Groups.Add(Group{CreatorID: tid.ID, GroupID: [8]byte{byte(i)}, Members: []IDString{id}})
+			sc.ID.Groups.List()
+		}
+	}()
+
+	for i := 0; i < messages; i++ {
+		select {
+		case rmsg := <-sc.receiveMsgChan.Out:
+			if rmsg.Err != nil {
+				t.Fatal(rmsg.Err)
+			}
+			tm, ok := rmsg.Msg.(TextMessage)
+			if !ok || tm.Text() != fmt.Sprintf("from peer %d", i) {
+				t.Fatalf("unexpected message %d: %#v", i, rmsg.Msg)
+			}
+		case err := <-sc.ErrorChan:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+	wg.Wait()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case err := <-sc.ErrorChan:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the client to send")
+	}
+}
+
+func TestKeyChangeRefusal(t *testing.T) {
+	goodPK, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := ThreemaContact{ID: NewIDString("GOODPEER"), LPK: *goodPK}
+	changed := ThreemaContact{ID: NewIDString("CHANGED1"), LPK: [32]byte{1}}
+
+	tid, err := NewThreemaID("TESTSELF", [32]byte{7}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Contacts.Add(good)
+	tid.Contacts.Add(changed)
+	if _, err := tid.Contacts.Pin(ThreemaContact{ID: changed.ID, LPK: [32]byte{2}}); err == nil {
+		t.Fatal("key change not recorded")
+	}
+	sc := NewSessionContext(tid)
+	fs := newFakeServer(t, sc)
+
+	// the message to the good peer and the ack of the refused message
+	done := make(chan error)
+	go func() { done <- fs.countFrames(2) }()
+	go sc.receiveLoop()
+	fs.send(t, serializePktType(new(bytes.Buffer), connEstablished).Bytes())
+
+	for _, c := range []ThreemaContact{changed, good} {
+		tm, err := NewTextMessage(sc, c.String(), "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.sendMsgChan.In <- tm
+	}
+	select {
+	case err := <-sc.ErrorChan:
+		if kc, ok := err.(KeyChange); !ok || kc.ID != changed.ID {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("refused send not reported")
+	}
+
+	n := newRandomNonce()
+	fs.send(t, serializeMsgPkt(messagePacket{
+		PktType:    deliveringMsg,
+		Sender:     changed.ID,
+		Recipient:  tid.ID,
+		ID:         1,
+		Time:       time.Now(),
+		Nonce:      n,
+		Ciphertext: make([]byte, 32),
+	}).Bytes())
+	select {
+	case rmsg := <-sc.receiveMsgChan.Out:
+		if _, ok := rmsg.Err.(KeyChange); !ok || rmsg.Msg != nil {
+			t.Errorf("unexpected message: %#v", rmsg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("refused message not surfaced")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case err := <-sc.ErrorChan:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the client to send")
+	}
+}
+
+func TestBlockedSender(t *testing.T) {
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := ThreemaContact{ID: NewIDString("TESTPEER"), LPK: *peerPK}
+	blocked := ThreemaContact{ID: NewIDString("BLOCKED1"), LPK: *peerPK, Blocked: true}
+
+	tid, err := NewThreemaID("TESTSELF", [32]byte{7}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Contacts.Add(peer)
+	tid.Contacts.Add(blocked)
+	sc := NewSessionContext(tid)
+	fs := newFakeServer(t, sc)
+
+	// both messages are acknowledged
+	done := make(chan error)
+	go func() { done <- fs.countFrames(2) }()
+	go sc.receiveLoop()
+
+	for i, c := range []ThreemaContact{blocked, peer} {
+		tm := TextMessage{
+			messageHeader{sender: c.ID, recipient: tid.ID, id: uint64(i), time: time.Now()},
+			textMessageBody{text: "hello from " + c.String()}}
+		n := newRandomNonce()
+		fs.send(t, serializeMsgPkt(messagePacket{
+			PktType:    deliveringMsg,
+			Sender:     c.ID,
+			Recipient:  tid.ID,
+			ID:         uint64(i),
+			Time:       time.Now(),
+			Nonce:      n,
+			Ciphertext: box.Seal(nil, tm.Serialize(), n.bytes(), tid.GetPubKey(), peerSK),
+		}).Bytes())
+	}
+
+	select {
+	case rmsg := <-sc.receiveMsgChan.Out:
+		if tm, ok := rmsg.Msg.(TextMessage); !ok || tm.Sender() != peer.ID {
+			t.Fatalf("unexpected message: %#v", rmsg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for acknowledgements")
+	}
+}
+
+func TestUndecryptableMessage(t *testing.T) {
+	peerPK, peerSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := ThreemaContact{ID: NewIDString("TESTPEER"), LPK: *peerPK}
+	fa := newFakeAPI()
+	fa.keys[peer.String()] = peer.LPK
+	srv := httptest.NewServer(fa.handler(t))
+	defer srv.Close()
+
+	tid, err := NewThreemaID("TESTSELF", [32]byte{7}, NewAddressBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid.Contacts.Add(peer)
+	sc := NewSessionContext(tid)
+	sc.Rest = NewThreemaRest(srv.URL, srv.Client())
+	fs := newFakeServer(t, sc)
+
+	// the message of the unknown sender is not acknowledged, the connection blocks on a third ack
+	done := make(chan error)
+	go func() { done <- fs.countFrames(2) }()
+	go sc.receiveLoop()
+
+	tm := TextMessage{
+		messageHeader{sender: peer.ID, recipient: tid.ID, id: 3, time: time.Now()},
+		textMessageBody{text: "hello"}}
+	for i, mp := range []struct {
+		sender     IDString
+		ciphertext []byte
+	}{
+		{NewIDString("UNKNOWN1"), make([]byte, 32)},
+		{peer.ID, make([]byte, 32)},
+		{peer.ID, nil},
+	} {
+		n := newRandomNonce()
+		if mp.ciphertext == nil {
+			mp.ciphertext = box.Seal(nil, tm.Serialize(), n.bytes(), tid.GetPubKey(), peerSK)
+		}
+		fs.send(t, serializeMsgPkt(messagePacket{
+			PktType:    deliveringMsg,
+			Sender:     mp.sender,
+			Recipient:  tid.ID,
+			ID:         uint64(i + 1),
+			Time:       time.Now(),
+			Nonce:      n,
+			Ciphertext: mp.ciphertext,
+		}).Bytes())
+	}
+
+	var received []ReceivedMsg
+	for len(received) < 3 {
+		select {
+		case rmsg := <-sc.receiveMsgChan.Out:
+			received = append(received, rmsg)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out after %d messages", len(received))
+		}
+	}
+	if err := received[0].Err; err == nil || !strings.Contains(err.Error(), "UNKNOWN1") {
+		t.Errorf("failed lookup not reported: %v", err)
+	}
+	if err, ok := received[1].Err.(UndecryptableMessage); !ok || err.Sender != peer.ID || err.ID != 2 {
+		t.Errorf("undecryptable message not reported: %v", received[1].Err)
+	}
+	if m, ok := received[2].Msg.(TextMessage); !ok || m.Text() != "hello" {
+		t.Errorf("unexpected message: %#v", received[2])
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for acknowledgements")
+	}
+}
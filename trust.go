@@ -0,0 +1,160 @@
+package o3
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeyChange is raised when the directory server returns a public key for a contact that differs
+// from the one pinned in the AddressBook. It implements the error interface.
+type KeyChange struct {
+	ID     IDString
+	Pinned [32]byte          // the public key stored in the AddressBook
+	New    [32]byte          // the public key returned by the server
+	Level  VerificationLevel // the verification level of the pinned key
+}
+
+func (kc KeyChange) Error() string {
+	return fmt.Sprintf("public key of %s differs from the pinned key (pinned: %x, server: %x)", kc.ID, kc.Pinned, kc.New)
+}
+
+// UndecryptableMessage is received in place of a message that could not be decrypted with the
+// public key of its sender. It implements the error interface.
+type UndecryptableMessage struct {
+	Sender IDString
+	ID     uint64 // the message ID
+}
+
+func (um UndecryptableMessage) Error() string {
+	return fmt.Sprintf("cannot decrypt message %x from %s", um.ID, um.Sender)
+}
+
+// lookupContact returns the contact with the given ID from the AddressBook. Unknown contacts are
+// fetched from the directory server and pinned. Contacts with an unresolved KeyChange are refused.
+func (sc *SessionContext) lookupContact(id IDString) (ThreemaContact, error) {
+	if kc, changed := sc.ID.Contacts.KeyChanged(id.String()); changed {
+		return ThreemaContact{}, kc
+	}
+	if contact, ok := sc.ID.Contacts.Get(id.String()); ok {
+		return contact, nil
+	}
+	return sc.fetchAndPin(id)
+}
+
+// RefreshContact fetches the public key of the given ID from the directory server and compares it
+// against the pinned key. If they differ, the KeyChange is recorded in the AddressBook, sent on
+// KeyChangeChan and returned as error.
+func (sc *SessionContext) RefreshContact(id string) (ThreemaContact, error) {
+	cid, err := ParseIDString(id)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	return sc.fetchAndPin(cid)
+}
+
+func (sc *SessionContext) fetchAndPin(id IDString) (ThreemaContact, error) {
+	fetched, err := sc.Rest.GetContactByID(id)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	fetched.Level = SERVERFETCHED
+
+	contact, err := sc.ID.Contacts.Pin(fetched)
+	if kc, ok := err.(KeyChange); ok {
+		sc.notifyKeyChange(kc)
+	}
+	return contact, err
+}
+
+// notifyKeyChange passes kc on to the application without ever blocking the session
+func (sc *SessionContext) notifyKeyChange(kc KeyChange) {
+	select {
+	case sc.KeyChangeChan <- kc:
+	default:
+	}
+}
+
+const qrPayloadPrefix = "3mid:"
+
+// QRPayload returns the payload of the contact QR code other users scan to verify this ID
+func (thid ThreemaID) QRPayload() string {
+	return qrPayloadPrefix + thid.String() + "," + hex.EncodeToString(thid.GetPubKey()[:])
+}
+
+// QRPayload returns the payload of the QR code of the contact as shown in its app
+func (tc ThreemaContact) QRPayload() string {
+	return qrPayloadPrefix + tc.String() + "," + hex.EncodeToString(tc.LPK[:])
+}
+
+// ParseQRPayload parses a scanned contact QR code of the form "3mid:<ID>,<hex public key>" into a
+// ThreemaContact. Additional comma-separated fields appended by newer apps are ignored.
+func ParseQRPayload(payload string) (ThreemaContact, error) {
+	if !strings.HasPrefix(payload, qrPayloadPrefix) {
+		return ThreemaContact{}, errors.New("not a Threema contact QR code")
+	}
+	fields := strings.Split(strings.TrimPrefix(payload, qrPayloadPrefix), ",")
+	if len(fields) < 2 {
+		return ThreemaContact{}, errors.New("QR code payload lacks the public key")
+	}
+	id, err := ParseIDString(fields[0])
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	lpk, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	if len(lpk) != 32 {
+		return ThreemaContact{}, fmt.Errorf("invalid public key length in QR code payload: %d", len(lpk))
+	}
+
+	contact := ThreemaContact{ID: id}
+	copy(contact.LPK[:], lpk)
+	return contact, nil
+}
+
+// Verify checks a scanned contact QR code payload against the public key stored in the AddressBook
+// and raises the contact to FULLYVERIFIED. Unknown contacts are added. A pending KeyChange is
+// resolved in favour of whichever key was scanned. Verify returns the verified contact or an error
+// if the scanned key does not match.
+func (a *AddressBook) Verify(payload string) (ThreemaContact, error) {
+	scanned, err := ParseQRPayload(payload)
+	if err != nil {
+		return ThreemaContact{}, err
+	}
+	id := scanned.String()
+
+	mu := a.lock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if kc, changed := a.keyChanges[id]; changed {
+		switch scanned.LPK {
+		case kc.New:
+			if err := a.acceptKeyChange(id); err != nil {
+				return ThreemaContact{}, err
+			}
+		case kc.Pinned:
+			delete(a.keyChanges, id)
+		}
+	}
+
+	contact, ok := a.get(id)
+	if !ok {
+		contact = scanned
+	} else if contact.LPK != scanned.LPK {
+		return contact, fmt.Errorf("scanned public key of %s does not match the stored key", id)
+	}
+	contact.Level = FULLYVERIFIED
+	a.add(contact)
+	return contact, nil
+}
+
+// WriteQRCode renders the QR code of the ID's QRPayload as PNG image to w. Each module of the code
+// is scale pixels wide.
+func (thid ThreemaID) WriteQRCode(w io.Writer, scale int) error {
+	return WriteQRCode(w, thid.QRPayload(), scale)
+}